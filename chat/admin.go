@@ -0,0 +1,210 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+// HTTP API for back-office tools, under /admin/, authenticated by a bearer
+// token
+type Admin struct {
+	token  string
+	server *Server
+}
+
+// An empty token disables the API
+func NewAdmin(token string, server *Server) *Admin {
+	return &Admin{token, server}
+}
+
+// Registers the API's handlers, unless it's disabled
+func (a *Admin) Register() {
+	if a.token == "" {
+		return
+	}
+	http.HandleFunc("/admin/transfer", a.authorized(a.serveTransfer))
+	http.HandleFunc("/admin/canned", a.authorized(a.serveCanned))
+	http.HandleFunc("/admin/transcript", a.authorized(a.serveTranscript))
+	http.HandleFunc("/admin/block", a.authorized(a.serveBlock))
+	http.HandleFunc("/admin/limits", a.authorized(a.serveLimits))
+}
+
+// Rejects requests without the token
+func (a *Admin) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type transferRequest struct {
+	Session    string `json:"session"`
+	Agent      string `json:"agent"`
+	Kick       bool   `json:"kick"`       // removes the previous agent
+	Supervisor bool   `json:"supervisor"` // only invites the agent, as a supervisor
+}
+
+// Transfers a session's conversation to an agent, or pulls in a supervisor
+func (a *Admin) serveTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req transferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	agent := mid.UserID(req.Agent)
+	if _, _, err := agent.Parse(); err != nil || req.Session == "" {
+		http.Error(w, "A session and an agent's Matrix ID are needed", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if req.Supervisor {
+		err = a.server.Supervise(req.Session, agent, "The admin API")
+	} else {
+		err = a.server.Transfer(req.Session, agent, "The admin API", req.Kick)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Lists the canned responses on GET, stores the one posted, or deletes the one
+// named by ?name=
+func (a *Admin) serveCanned(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := LoadCanned()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost, http.MethodPut:
+		var canned Canned
+		if err := json.NewDecoder(r.Body).Decode(&canned); err != nil || canned.Name == "" || canned.Body == "" {
+			http.Error(w, "A name and a body are needed", http.StatusBadRequest)
+			return
+		}
+		if strings.ContainsAny(canned.Name, " \t\n") || len(canned.Name) > 100 {
+			http.Error(w, "Names are a single word", http.StatusBadRequest)
+			return
+		}
+		if err := canned.Save(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		removed, err := DeleteCanned(r.URL.Query().Get("name"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Serves the staff transcript of the session given as ?session=, with the
+// agents' internal notes
+func (a *Admin) serveTranscript(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessid := r.URL.Query().Get("session")
+	if sessid == "" {
+		http.Error(w, "A session is needed", http.StatusBadRequest)
+		return
+	}
+	text, err := Transcript(sessid, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(text))
+}
+
+// Serves how many frames, sessions and rooms this instance's rate limits
+// rejected since it started
+func (a *Admin) serveLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limitCounters.Snapshot())
+}
+
+// Lists the blocklist on GET, adds the entry posted, or lifts the one given as
+// ?kind=&value=. Blocking closes the sockets and conversations of the sessions
+// the entry matches, as !block does
+func (a *Admin) serveBlock(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := LoadBlocks()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost:
+		var block Block
+		if err := json.NewDecoder(r.Body).Decode(&block); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if _, err := normalizeBlock(block.Kind, block.Value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := AddBlock(block.Kind, block.Value, block.Reason, "The admin API"); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := a.server.enforceBlock(block.Kind, block.Value); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		kind, value := r.URL.Query().Get("kind"), r.URL.Query().Get("value")
+		if _, err := normalizeBlock(kind, value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		removed, err := RemoveBlock(kind, value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,185 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// Rules the bot answers visitors with on its own, with canned responses
+type AutoReplies struct {
+	Greeting string // canned response greeting each conversation, if any
+	rules    []*replyRule
+}
+
+// Answers a message containing any of the keywords, or matching the pattern
+type replyRule struct {
+	keywords []string
+	pattern  *regexp.Regexp
+	response string
+}
+
+// The rules file, responses being the canned responses stored on first load,
+// then edited with the admin API
+type autoReplyFile struct {
+	Greeting string `json:"greeting"`
+	Rules    []struct {
+		Keywords []string `json:"keywords"`
+		Pattern  string   `json:"pattern"`
+		Response string   `json:"response"`
+	} `json:"rules"`
+	Responses map[string]string `json:"responses"`
+}
+
+// Loads the auto-reply rules from a JSON file, storing the canned responses
+// it has which aren't stored yet. No path, no rules, nil is returned then
+func LoadAutoReplies(path string) (*AutoReplies, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file autoReplyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	replies := &AutoReplies{Greeting: file.Greeting}
+	for i, rule := range file.Rules {
+		if rule.Response == "" || (len(rule.Keywords) == 0 && rule.Pattern == "") {
+			return nil, fmt.Errorf("rule %d needs keywords or a pattern, and a response", i+1)
+		}
+		r := &replyRule{response: rule.Response}
+		for _, keyword := range rule.Keywords {
+			r.keywords = append(r.keywords, strings.ToLower(keyword))
+		}
+		if rule.Pattern != "" {
+			if r.pattern, err = regexp.Compile(rule.Pattern); err != nil {
+				return nil, fmt.Errorf("rule %d: %s", i+1, err)
+			}
+		}
+		replies.rules = append(replies.rules, r)
+	}
+	for name, body := range file.Responses {
+		canned := &Canned{Name: name, Body: body}
+		if err := canned.CreateIfMissing(); err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// The canned response of the first rule the message matches, empty if none
+func (a *AutoReplies) match(body string) string {
+	lower := strings.ToLower(body)
+	for _, rule := range a.rules {
+		for _, keyword := range rule.keywords {
+			if strings.Contains(lower, keyword) {
+				return rule.response
+			}
+		}
+		if rule.pattern != nil && rule.pattern.MatchString(body) {
+			return rule.response
+		}
+	}
+	return ""
+}
+
+// Whether the visitor's message numbered seq is the first of their
+// conversation, the session's first or the first since its last was closed.
+// Messages being numbered in order, exactly one is, however quickly they come
+func firstOfConversation(sessid string, seq int) bool {
+	var closed sql.NullString
+	row := DB.GetDB().QueryRow("SELECT MAX(closed) FROM Conversation WHERE session = ? AND state = ?", sessid, StateClosed)
+	if err := row.Scan(&closed); err != nil {
+		return false
+	}
+	query := "SELECT COUNT(*) FROM Message WHERE session = ? AND author != '0' AND seq < ?"
+	args := []interface{}{sessid, seq}
+	if closed.Valid && closed.String != "" {
+		query += " AND created >= ?"
+		args = append(args, closed.String)
+	}
+	var count int
+	if err := DB.GetDB().QueryRow(query, args...).Scan(&count); err != nil {
+		return false
+	}
+	return count == 0
+}
+
+// Whether the visitor's message just stored should be greeted
+func (s *Server) greets(sessid string, message *Message) bool {
+	return s.replies != nil && s.replies.Greeting != "" && firstOfConversation(sessid, message.Seq)
+}
+
+// Answers a visitor's message on the bot's own: with the greeting if greet,
+// and with the response of the first rule it matches. Agents see the answers
+// in the room if relay
+func (s *Server) autoReply(c *Client, message *Message, greet, relay bool) {
+	if s.replies == nil {
+		return
+	}
+	sessid := *c.session.SessionId
+	names := []string{}
+	if greet {
+		names = append(names, s.replies.Greeting)
+	}
+	if name := s.replies.match(*message.Body); name != "" {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return
+	}
+	var room mid.RoomID
+	if relay {
+		var err error
+		if room, err = s.roomOf(c); err != nil {
+			log.Println("Could not relay auto reply:", err)
+		}
+	}
+	for _, name := range names {
+		canned, err := FindCanned(name)
+		if err != nil || canned == nil {
+			log.Printf("Could not find the canned response %s: %v", name, err)
+			continue
+		}
+		s.sendCanned(sessid, room, canned.Body, true, Profile{})
+	}
+}
+
+// Sends the visitor a message the bot writes for an agent, or on its own if
+// auto, which agents see in the room too, unless it's empty
+func (s *Server) sendCanned(sessid string, room mid.RoomID, body string, auto bool, profile Profile) {
+	author := "0"
+	msg := NewMessage(&author, &body)
+	*msg.Session = sessid
+	*msg.Name = profile.Name
+	*msg.Avatar = profile.Avatar
+	msg.Auto = auto
+	if err := msg.Create(); err != nil {
+		log.Println("Could not store message:", err)
+	}
+	s.publish(&SessionEvent{Session: sessid, Frame: msg.Frame(), Message: msg})
+	if room == "" {
+		return
+	}
+	content := mevent.MessageEventContent{MsgType: mevent.MsgText, Body: body}
+	if auto {
+		content.MsgType = mevent.MsgNotice
+	}
+	resp, err := s.Mautrix_client.SendMessage(room, &content, "")
+	if err != nil {
+		return
+	}
+	if err := msg.SetEventID(room, resp.EventID); err != nil {
+		log.Println("Could not store message event:", err)
+	}
+}
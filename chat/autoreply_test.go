@@ -0,0 +1,82 @@
+package chat
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Messages the bot sent the session on its own
+func countAutoReplies(t *testing.T, sessid string) int {
+	t.Helper()
+	return countRows(t, "SELECT COUNT(*) FROM Message WHERE session = ? AND auto = 1", sessid)
+}
+
+func TestGreetingOncePerConversation(t *testing.T) {
+	s := newTestServer(t)
+	newFakeHomeserver(t, s)
+	s.replies = &AutoReplies{Greeting: "greeting"}
+	if err := (&Canned{Name: "greeting", Body: "Hello, an agent is on their way"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+	c, done := listenTestClient(t, s, newFakeTransport(), "visitor")
+	defer func() {
+		c.Close()
+		waitFor(t, done, "the client to stop")
+	}()
+	// received together, from several sockets
+	receive := func(count int, prefix string) {
+		var wg sync.WaitGroup
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				s.Receive(c, JSONMessage{ID: fmt.Sprintf("%s%d", prefix, i), Body: "Hi"})
+			}(i)
+		}
+		wg.Wait()
+	}
+	greeted := func(want int) {
+		t.Helper()
+		eventually(t, func() bool { return countAutoReplies(t, "visitor") >= want }, "the greeting")
+		time.Sleep(50 * time.Millisecond)
+		if n := countAutoReplies(t, "visitor"); n != want {
+			t.Fatalf("greeted %d times, want %d", n, want)
+		}
+	}
+
+	// no conversation was ever closed
+	receive(5, "a")
+	greeted(1)
+	receive(1, "b")
+	greeted(1)
+
+	// closed since
+	past := time.Now().UTC().Add(-time.Hour).Format(TimeFormat)
+	if _, err := DB.GetDB().Exec("UPDATE Message SET created = ?", past); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.GetDB().Exec("UPDATE Conversation SET state = ?, closed = ?", StateClosed, time.Now().UTC().Add(-time.Minute).Format(TimeFormat)); err != nil {
+		t.Fatal(err)
+	}
+	receive(3, "c")
+	greeted(2)
+}
+
+func TestAutoReplyMatch(t *testing.T) {
+	replies := &AutoReplies{rules: []*replyRule{
+		{keywords: []string{"price", "cost"}, response: "pricing"},
+		{pattern: regexp.MustCompile(`(?i)\border #?\d+`), response: "orders"},
+	}}
+	for body, want := range map[string]string{
+		"How much does it COST?": "pricing",
+		"Where is order #1234":   "orders",
+		"Where is my order":      "",
+	} {
+		if got := replies.match(body); got != want {
+			t.Errorf("%q matched %q, want %q", body, got, want)
+		}
+	}
+}
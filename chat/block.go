@@ -0,0 +1,300 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Kinds of blocklist entries
+const (
+	BlockIP      = "ip"
+	BlockCIDR    = "cidr"
+	BlockSession = "session"
+	BlockEmail   = "email"
+)
+
+var errBlocked = errors.New("blocked")
+
+// Visitor kept from creating sessions and connecting, by IP address, network,
+// session or email address
+type Block struct {
+	Id      int    `json:"id"`
+	Kind    string `json:"kind"`
+	Value   string `json:"value"`
+	Reason  string `json:"reason"`
+	Author  string `json:"author"` // Matrix ID of the agent who blocked
+	Created string `json:"created"`
+}
+
+// The canonical form of an IP address, brackets around IPv6 ones allowed, or
+// nil if it isn't one
+func parseIP(ip string) net.IP {
+	if strings.HasPrefix(ip, "[") && strings.HasSuffix(ip, "]") {
+		ip = ip[1 : len(ip)-1]
+	}
+	return net.ParseIP(ip)
+}
+
+// The form an entry's value is stored and looked up in
+func normalizeBlock(kind, value string) (string, error) {
+	switch kind {
+	case BlockIP:
+		if addr := parseIP(value); addr != nil {
+			return addr.String(), nil
+		}
+		return "", fmt.Errorf("%s is not a valid IP address", value)
+	case BlockCIDR:
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return "", fmt.Errorf("%s is not a valid network", value)
+		}
+		return network.String(), nil
+	case BlockSession:
+		if value == "" {
+			return "", fmt.Errorf("no session given")
+		}
+		return value, nil
+	case BlockEmail:
+		if value == "" {
+			return "", fmt.Errorf("no email address given")
+		}
+		return strings.ToLower(value), nil
+	}
+	return "", fmt.Errorf("unknown kind of block %q", kind)
+}
+
+// Adds an entry to the blocklist, unless it's already there
+func AddBlock(kind, value, reason, author string) error {
+	value, err := normalizeBlock(kind, value)
+	if err != nil {
+		return err
+	}
+	var count int
+	row := DB.GetDB().QueryRow("SELECT COUNT(*) FROM Block WHERE kind = ? AND value = ?", kind, value)
+	if err := row.Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = DB.GetDB().Exec("INSERT INTO Block (kind, value, reason, author, created) VALUES (?, ?, ?, ?, ?)",
+		kind, value, reason, author, time.Now().UTC().Format(TimeFormat))
+	return err
+}
+
+// Removes an entry from the blocklist, returning whether there was one
+func RemoveBlock(kind, value string) (bool, error) {
+	value, err := normalizeBlock(kind, value)
+	if err != nil {
+		return false, err
+	}
+	res, err := DB.GetDB().Exec("DELETE FROM Block WHERE kind = ? AND value = ?", kind, value)
+	if err != nil {
+		return false, err
+	}
+	removed, err := res.RowsAffected()
+	return removed > 0, err
+}
+
+// Lists the blocklist, oldest entries first
+func LoadBlocks() ([]*Block, error) {
+	rows, err := DB.GetDB().Query("SELECT id, kind, value, COALESCE(reason, ''), COALESCE(author, ''), COALESCE(created, '') FROM Block ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blocks := []*Block{}
+	for rows.Next() {
+		b := &Block{}
+		if err := rows.Scan(&b.Id, &b.Kind, &b.Value, &b.Reason, &b.Author, &b.Created); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, rows.Err()
+}
+
+// Whether any of the given IP address, session or email address is blocked.
+// Empty ones are ignored. Exact entries are looked up by the index, only
+// networks are scanned
+func IsBlocked(ip, sessid, email string) (bool, error) {
+	where := []string{}
+	args := []interface{}{}
+	addr := parseIP(ip)
+	if addr != nil {
+		where = append(where, "(kind = ? AND value = ?)")
+		args = append(args, BlockIP, addr.String())
+	}
+	if sessid != "" {
+		where = append(where, "(kind = ? AND value = ?)")
+		args = append(args, BlockSession, sessid)
+	}
+	if email != "" {
+		where = append(where, "(kind = ? AND value = ?)")
+		args = append(args, BlockEmail, strings.ToLower(email))
+	}
+	if len(where) > 0 {
+		var count int
+		row := DB.GetDB().QueryRow("SELECT COUNT(*) FROM Block WHERE "+strings.Join(where, " OR "), args...)
+		if err := row.Scan(&count); err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	if addr == nil {
+		return false, nil
+	}
+
+	rows, err := DB.GetDB().Query("SELECT value FROM Block WHERE kind = ?", BlockCIDR)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return false, err
+		}
+		if _, network, err := net.ParseCIDR(value); err == nil && network.Contains(addr) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// Answers a request which couldn't be authenticated
+func authError(w http.ResponseWriter, err error) {
+	if err == errBlocked {
+		http.Error(w, "Blocked", http.StatusForbidden)
+		return
+	}
+	http.Error(w, "No valid session cookie", http.StatusUnauthorized)
+}
+
+// Runs an agent's !block or !unblock command. Without argument the session is
+// blocked, "ip" and "email" block the session's IP or email address, and an
+// IP address or a network in CIDR notation blocks it. Anything after that is
+// the reason. Blocking closes the session's sockets and the conversation,
+// blocks are lifted in another conversation or with the admin API
+func blockCommand(cmd *Command) error {
+	kind, value := BlockSession, cmd.Session
+	reason := cmd.Text()
+	if len(cmd.Args) > 0 {
+		session := NewSession(nil, nil)
+		if err := DB.GetByPk(session, cmd.Session, "session"); err != nil {
+			return err
+		}
+		target := true
+		switch arg := cmd.Args[0]; {
+		case arg == BlockIP:
+			kind, value = BlockIP, *session.IpAddr
+		case arg == BlockEmail:
+			kind, value = BlockEmail, *session.Email
+		case parseIP(arg) != nil:
+			kind, value = BlockIP, arg
+		case strings.Contains(arg, "/"):
+			kind, value = BlockCIDR, arg
+		default:
+			// no target given, it's all reason
+			target = false
+		}
+		if target {
+			reason = strings.Join(cmd.Args[1:], " ")
+		}
+	}
+	if value == "" {
+		return fmt.Errorf("the visitor has no %s address", kind)
+	}
+
+	if cmd.Name == "unblock" {
+		removed, err := RemoveBlock(kind, value)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return fmt.Errorf("that %s was not blocked", kind)
+		}
+		cmd.Reply("Unblocked the %s", kind)
+		return nil
+	}
+
+	if err := AddBlock(kind, value, reason, cmd.Sender.String()); err != nil {
+		return err
+	}
+	cmd.Reply("Blocked the %s, closing the conversation", kind)
+	_, err := cmd.Server.enforceBlock(kind, value)
+	return err
+}
+
+// The sessions a blocklist entry matches
+func blockedSessions(kind, value string) ([]string, error) {
+	value, err := normalizeBlock(kind, value)
+	if err != nil {
+		return nil, err
+	}
+	var rows *sql.Rows
+	switch kind {
+	case BlockSession:
+		return []string{value}, nil
+	case BlockIP:
+		// stored with brackets by older versions
+		rows, err = DB.GetDB().Query("SELECT session FROM Session WHERE ip = ? OR ip = ?", value, "["+value+"]")
+	case BlockEmail:
+		rows, err = DB.GetDB().Query("SELECT session FROM Session WHERE LOWER(email) = ?", value)
+	case BlockCIDR:
+		rows, err = DB.GetDB().Query("SELECT session, ip FROM Session WHERE ip IS NOT NULL AND ip != ''")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	_, network, _ := net.ParseCIDR(value)
+	sessions := []string{}
+	for rows.Next() {
+		var sessid, ip string
+		dest := []interface{}{&sessid}
+		if kind == BlockCIDR {
+			dest = append(dest, &ip)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if kind == BlockCIDR {
+			if addr := parseIP(ip); addr == nil || !network.Contains(addr) {
+				continue
+			}
+		}
+		sessions = append(sessions, sessid)
+	}
+	return sessions, rows.Err()
+}
+
+// Closes the sockets and the conversation of every session a new blocklist
+// entry matches, the bot leaving their rooms. Returns how many there were
+func (s *Server) enforceBlock(kind, value string) (int, error) {
+	sessions, err := blockedSessions(kind, value)
+	if err != nil {
+		return 0, err
+	}
+	for _, sessid := range sessions {
+		s.publish(&SessionEvent{Session: sessid, Kick: "blocked"})
+		conv, err := CurrentConversation(sessid)
+		if err != nil {
+			return 0, err
+		}
+		if conv == nil {
+			continue
+		}
+		if err := s.CloseConversation(sessid, ClosedByAgent); err != nil {
+			return 0, err
+		}
+	}
+	return len(sessions), nil
+}
@@ -0,0 +1,189 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsBlocked(t *testing.T) {
+	newTestServer(t)
+	for _, block := range []struct{ kind, value string }{
+		{BlockIP, "192.0.2.1"},
+		{BlockIP, "[2001:db8::1]"},
+		{BlockCIDR, "198.51.100.0/24"},
+		{BlockSession, "troll"},
+		{BlockEmail, "Troll@Example.org"},
+	} {
+		if err := AddBlock(block.kind, block.value, "", "@agent:example.org"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		ip, sessid, email string
+		blocked           bool
+	}{
+		{"192.0.2.1", "", "", true},
+		{"192.0.2.2", "", "", false},
+		{"::ffff:192.0.2.1", "", "", true},
+		{"2001:db8::1", "", "", true},
+		{"[2001:db8::1]", "", "", true},
+		{"2001:db8:0:0:0:0:0:1", "", "", true},
+		{"198.51.100.77", "", "", true},
+		{"198.51.101.1", "", "", false},
+		{"", "troll", "", true},
+		{"", "visitor", "", false},
+		{"", "", "troll@example.org", true},
+		{"", "", "TROLL@EXAMPLE.ORG", true},
+		{"", "", "ada@example.org", false},
+		{"garbage", "", "", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		blocked, err := IsBlocked(test.ip, test.sessid, test.email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blocked != test.blocked {
+			t.Errorf("IsBlocked(%q, %q, %q) = %v, want %v", test.ip, test.sessid, test.email, blocked, test.blocked)
+		}
+	}
+}
+
+func TestAddBlockValidates(t *testing.T) {
+	newTestServer(t)
+	for _, block := range []struct{ kind, value string }{
+		{BlockIP, "192.0.2"},
+		{BlockIP, "[192.0.2.1"},
+		{BlockIP, ""},
+		{BlockCIDR, "192.0.2.0/33"},
+		{BlockEmail, ""},
+		{"name", "Ada"},
+	} {
+		if err := AddBlock(block.kind, block.value, "", ""); err == nil {
+			t.Errorf("blocked %s %q", block.kind, block.value)
+		}
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM Block"); n != 0 {
+		t.Errorf("%d invalid entries stored", n)
+	}
+
+	// stored once, in the canonical form
+	for _, value := range []string{"[2001:DB8::1]", "2001:db8:0::1"} {
+		if err := AddBlock(BlockIP, value, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM Block WHERE value = '2001:db8::1'"); n != 1 {
+		t.Errorf("%d entries of the address, want 1", n)
+	}
+	if removed, err := RemoveBlock(BlockIP, "2001:db8::0:1"); err != nil || !removed {
+		t.Errorf("address not unblocked: %v, %v", removed, err)
+	}
+}
+
+func TestBlockCommandClosesConversation(t *testing.T) {
+	s := newTestServer(t)
+	hs := newFakeHomeserver(t, s)
+	newTestSession(t, "visitor", "!room:example.org")
+
+	cmd := &Command{Server: s, Session: "visitor", Room: "!room:example.org", Sender: "@agent:example.org", Name: "block", Args: []string{"ip", "spam"}}
+	if err := blockCommand(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, err := IsBlocked("192.0.2.1", "", ""); err != nil || !blocked {
+		t.Errorf("visitor's address not blocked: %v, %v", blocked, err)
+	}
+	if conv, err := CurrentConversation("visitor"); err != nil || conv != nil {
+		t.Errorf("conversation %+v left open: %v", conv, err)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM Conversation WHERE closed_by = ?", ClosedByAgent); n != 1 {
+		t.Errorf("%d conversations closed by the agent, want 1", n)
+	}
+	if len(hs.sent("/leave")) != 1 {
+		t.Error("the bot didn't leave the room")
+	}
+}
+
+func TestAdminBlock(t *testing.T) {
+	s := newTestServer(t)
+	admin := NewAdmin("token", s)
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		admin.authorized(admin.serveBlock)(w, r)
+		return w
+	}
+
+	if w := serve("POST", "/admin/block", `{"kind": "ip", "value": "not an address"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid address answered %d", w.Code)
+	}
+	if w := serve("POST", "/admin/block", `{"kind": "cidr", "value": "198.51.100.0/24", "reason": "spam"}`); w.Code != http.StatusNoContent {
+		t.Fatalf("block answered %d: %s", w.Code, w.Body)
+	}
+	if w := serve("GET", "/admin/block", ""); !strings.Contains(w.Body.String(), `"value":"198.51.100.0/24"`) {
+		t.Errorf("blocklist %s", w.Body)
+	}
+	if blocked, _ := IsBlocked("198.51.100.7", "", ""); !blocked {
+		t.Error("network not blocked")
+	}
+	if w := serve("DELETE", "/admin/block?kind=cidr&value=198.51.100.0/24", ""); w.Code != http.StatusNoContent {
+		t.Errorf("unblock answered %d: %s", w.Code, w.Body)
+	}
+	if w := serve("DELETE", "/admin/block?kind=cidr&value=198.51.100.0/24", ""); w.Code != http.StatusNotFound {
+		t.Errorf("second unblock answered %d", w.Code)
+	}
+	if blocked, _ := IsBlocked("198.51.100.7", "", ""); blocked {
+		t.Error("network still blocked")
+	}
+}
+
+func TestAdminBlockClosesMatchingSessions(t *testing.T) {
+	tests := []struct{ kind, value string }{
+		{BlockIP, "192.0.2.1"},
+		{BlockCIDR, "192.0.2.0/24"},
+		{BlockEmail, "TROLL@example.org"},
+		{BlockSession, "troll"},
+	}
+	for _, test := range tests {
+		t.Run(test.kind, func(t *testing.T) {
+			s := newTestServer(t)
+			hs := newFakeHomeserver(t, s)
+			troll := newTestSession(t, "troll", "!troll:example.org")
+			newTestSession(t, "visitor", "!visitor:example.org")
+			if _, err := DB.GetDB().Exec("UPDATE Session SET email = 'troll@example.org' WHERE session = 'troll'"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := DB.GetDB().Exec("UPDATE Session SET ip = '203.0.113.9' WHERE session = 'visitor'"); err != nil {
+				t.Fatal(err)
+			}
+			transport := newFakeTransport()
+			s.Add(NewClient(transport, context.Background(), s, troll))
+
+			admin := NewAdmin("token", s)
+			body := `{"kind": "` + test.kind + `", "value": "` + test.value + `"}`
+			r := httptest.NewRequest("POST", "/admin/block", strings.NewReader(body))
+			r.Header.Set("Authorization", "Bearer token")
+			w := httptest.NewRecorder()
+			admin.authorized(admin.serveBlock)(w, r)
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("block answered %d: %s", w.Code, w.Body)
+			}
+
+			eventually(t, func() bool { return transport.closeCount() > 0 }, "the blocked visitor's socket to close")
+			if conv, err := CurrentConversation("troll"); err != nil || conv != nil {
+				t.Errorf("blocked visitor's conversation %+v left open: %v", conv, err)
+			}
+			if len(hs.sent("/rooms/!troll:example.org/leave")) != 1 {
+				t.Error("the bot didn't leave the blocked visitor's room")
+			}
+			if conv, err := CurrentConversation("visitor"); err != nil || conv == nil {
+				t.Errorf("other visitor's conversation closed: %v", err)
+			}
+		})
+	}
+}
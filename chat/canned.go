@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Answer agents send with !canned, and the bot with the auto-reply rules
+type Canned struct {
+	Name    string `json:"name"`
+	Body    string `json:"body"`
+	Updated string `json:"updated"`
+}
+
+// Stores the canned response, replacing any of the same name
+func (c *Canned) Save() error {
+	c.Updated = time.Now().UTC().Format(TimeFormat)
+	res, err := DB.GetDB().Exec("UPDATE Canned SET body = ?, updated = ? WHERE name = ?", c.Body, c.Updated, c.Name)
+	if err != nil {
+		return err
+	}
+	if updated, err := res.RowsAffected(); err != nil || updated > 0 {
+		return err
+	}
+	_, err = DB.GetDB().Exec("INSERT INTO Canned (name, body, updated) VALUES (?, ?, ?)", c.Name, c.Body, c.Updated)
+	return err
+}
+
+// Stores the canned response unless one of the same name exists, so that
+// edits survive restarts
+func (c *Canned) CreateIfMissing() error {
+	existing, err := FindCanned(c.Name)
+	if err != nil || existing != nil {
+		return err
+	}
+	return c.Save()
+}
+
+// Removes the canned response of that name, returning whether there was one
+func DeleteCanned(name string) (bool, error) {
+	res, err := DB.GetDB().Exec("DELETE FROM Canned WHERE name = ?", name)
+	if err != nil {
+		return false, err
+	}
+	removed, err := res.RowsAffected()
+	return removed > 0, err
+}
+
+// The canned response of that name, nil if there's none
+func FindCanned(name string) (*Canned, error) {
+	c := &Canned{}
+	row := DB.GetDB().QueryRow("SELECT name, body, updated FROM Canned WHERE name = ?", name)
+	err := row.Scan(&c.Name, &c.Body, &c.Updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Every canned response, sorted by name
+func LoadCanned() ([]*Canned, error) {
+	rows, err := DB.GetDB().Query("SELECT name, body, updated FROM Canned ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*Canned{}
+	for rows.Next() {
+		c := &Canned{}
+		if err := rows.Scan(&c.Name, &c.Body, &c.Updated); err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
@@ -1,46 +1,101 @@
 package chat
 
 import (
-	"fmt"
-	"io"
+	"context"
+	"encoding/json"
 	"log"
-	"net/http"
-
-	"golang.org/x/net/websocket"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const channelBufSize = 100
 
-var maxId int = 0
+// Time allowed to write a frame to the websocket
+const writeWait = 10 * time.Second
+
+// Messages the widget hasn't acknowledged within this time are written again
+const ackTimeout = 30 * time.Second
 
+// Bounds on what a client may cost the server. When a client's queue of frames
+// is full it's either closed as too slow, or its oldest frame is dropped
+type ClientLimits struct {
+	QueueSize    int
+	DropOldest   bool
+	MaxFrameSize int64 // largest frame read from a websocket, in bytes
+	Compression  bool  // negotiate permessage-deflate with websockets
+}
+
+func NewClientLimits(queue int, dropOldest bool, maxFrame int64, compression bool) *ClientLimits {
+	if queue <= 0 {
+		queue = channelBufSize
+	}
+	if maxFrame <= 0 {
+		maxFrame = 64 * 1024
+	}
+	return &ClientLimits{queue, dropOldest, maxFrame, compression}
+}
+
+// Keepalive settings for websockets. The server pings every Interval and the
+// client is dropped if nothing, not even a pong, is read within Timeout. Zero
+// Interval disables heartbeats
+type Heartbeat struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+func NewHeartbeat(interval, timeout time.Duration) *Heartbeat {
+	if timeout <= interval {
+		timeout = 2 * interval
+	}
+	return &Heartbeat{interval, timeout}
+}
+
+var maxId int64 = 0
+
+// Every client owns a context, cancelled exactly once by Close, which stops
+// both of its goroutines and removes it from the server
 type Client struct {
-	id      int
-	ws      *websocket.Conn
-	server  *Server
-	ch      chan *JSONMessage
-	doneCh  chan bool
-	session *Session
+	id        int
+	transport Transport
+	server    *Server
+	ch        chan *JSONMessage
+	ctx       context.Context
+	cancel    context.CancelFunc
+	once      sync.Once
+	session   *Session
+	lastPoll  int64 // unix time of the last poll, for long-polling clients
+
+	ackMutex sync.Mutex
+	sent     int       // highest sequence number written to the visitor
+	acked    int       // highest sequence number the visitor has
+	ackedAt  time.Time // last time acked caught up, or the visitor started waiting
+	acking   bool      // the widget acknowledges messages, older ones don't
 }
 
-func NewClient(ws *websocket.Conn, server *Server, token *http.Cookie) (error, *Client) {
-	if ws == nil {
-		panic("ws cannot be nil")
+// Creates a client of the session, reached through transport. It lives until
+// parent is done or it's closed
+func NewClient(transport Transport, parent context.Context, server *Server, session *Session) *Client {
+	if transport == nil {
+		panic("transport cannot be nil")
 	}
 	if server == nil {
 		panic("server cannot be nil")
 	}
 
-	maxId++
-	ch := make(chan *JSONMessage, channelBufSize)
-	doneCh := make(chan bool)
-	session := NewSession(nil, nil)
-	err := DB.GetByPk(session, token.Value, "session")
-	if err != nil {
-		log.Println(err)
-		return err, nil
-	}
+	id := int(atomic.AddInt64(&maxId, 1))
+	ch := make(chan *JSONMessage, server.limits.QueueSize)
+	ctx, cancel := context.WithCancel(parent)
 
-	return nil, &Client{maxId, ws, server, ch, doneCh, session}
+	return &Client{
+		id:        id,
+		transport: transport,
+		server:    server,
+		ch:        ch,
+		ctx:       ctx,
+		cancel:    cancel,
+		session:   session,
+	}
 }
 
 func (c *Client) GetRoomId() *string {
@@ -51,25 +106,118 @@ func (c *Client) GetSessionId() *string {
 	return c.session.GetSessionID()
 }
 
-func (c *Client) Conn() *websocket.Conn {
-	return c.ws
+// Queues a frame for the client. It never blocks: when the queue is full the
+// client is either closed, or loses its oldest frame, as the limits say
+func (c *Client) Write(msg *JSONMessage) {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case c.ch <- msg:
+			return
+		default:
+		}
+		if !c.server.limits.DropOldest {
+			log.Printf("client %d is not keeping up, closing it", c.id)
+			c.Kick(ClosePolicyViolation, "too slow")
+			return
+		}
+		select {
+		case <-c.ch:
+			log.Printf("client %d is not keeping up, dropped a frame", c.id)
+		default:
+		}
+	}
 }
 
-func (c *Client) Write(msg *JSONMessage) {
-	select {
-	case c.ch <- msg:
-	default:
+// Closes the client. Safe to call many times, and from any goroutine
+// including the server's Listen loop
+func (c *Client) Close() {
+	c.Kick(CloseNormal, "")
+}
+
+// Closes the client, telling the visitor why when the transport allows it.
+// Only the first call has an effect
+func (c *Client) Kick(code int, reason string) {
+	c.once.Do(func() {
+		c.cancel()
+		c.transport.Close(code, reason)
 		c.server.Del(c)
-		err := fmt.Errorf("client %d is disconnected.", c.id)
-		c.server.Err(err)
-	}
+	})
 }
 
 func (c *Client) Done() {
-	c.doneCh <- true
+	c.Close()
 }
 
+// Records that the visitor has every message up to seq, either acknowledged
+// or, on reconnection, the last one they've seen
+func (c *Client) Ack(seq int) {
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+	c.acking = true
+	if seq > c.acked {
+		c.acked = seq
+		c.ackedAt = time.Now()
+	}
+	if seq > c.sent {
+		c.sent = seq
+	}
+}
+
+// Records that a frame was written to the visitor
+func (c *Client) sentFrame(msg *JSONMessage) {
+	if msg.Seq == 0 {
+		return
+	}
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+	if c.sent == c.acked {
+		c.ackedAt = time.Now()
+	}
+	if msg.Seq > c.sent {
+		c.sent = msg.Seq
+	}
+}
+
+// Whether the message must still be written to the visitor
+func (c *Client) missing(msg *Message) bool {
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+	return msg.Seq == 0 || msg.Seq > c.acked
+}
+
+// Messages written to the visitor which they haven't acknowledged for longer
+// than timeout, oldest first. Widgets which never acknowledge anything get
+// nothing written again
+func (c *Client) unacked(timeout time.Duration) []*JSONMessage {
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+	if !c.acking || c.sent <= c.acked || time.Since(c.ackedAt) < timeout {
+		return nil
+	}
+	index := c.server.registry.Get(*c.session.SessionId)
+	if index == nil {
+		return nil
+	}
+	frames := []*JSONMessage{}
+	for _, msg := range index.History() {
+		if msg.Seq > c.acked && msg.Seq <= c.sent {
+			frames = append(frames, msg.Frame())
+		}
+	}
+	c.ackedAt = time.Now()
+	return frames
+}
+
+// Serves the client until it's closed, by either side. Clients which transport
+// can't read only write, their frames are posted to the server instead
 func (c *Client) Listen() {
+	if _, ok := c.transport.(Receiver); !ok {
+		defer c.Close()
+		c.listenWrite()
+		return
+	}
 	go c.listenWrite()
 	c.listenRead()
 }
@@ -90,46 +238,75 @@ func (c *Client) GetJSONMessages() []*JSONMessage {
 }
 
 func (c *Client) listenWrite() {
+	var ping <-chan time.Time
+	if hb := c.server.heartbeat; hb != nil && hb.Interval > 0 {
+		ticker := time.NewTicker(hb.Interval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	resend := time.NewTicker(ackTimeout / 2)
+	defer resend.Stop()
 	for {
 		select {
 
 		// send message to the client
 		case msg := <-c.ch:
-			websocket.JSON.Send(c.ws, msg)
+			if err := c.transport.Send(msg); err != nil {
+				log.Printf("client %d could not be written to: %s", c.id, err)
+				c.Close()
+				return
+			}
+			c.sentFrame(msg)
+
+		// the visitor may have missed messages, they're deduplicated by seq
+		case <-resend.C:
+			for _, msg := range c.unacked(ackTimeout) {
+				if err := c.transport.Send(msg); err != nil {
+					log.Printf("client %d could not be written to: %s", c.id, err)
+					c.Close()
+					return
+				}
+			}
 
-		// receive done request
-		case <-c.doneCh:
-			c.server.Del(c)
-			c.doneCh <- true // for listenRead method
+		// keep the connection alive, the browser answers with a pong
+		case <-ping:
+			if err := c.transport.Ping(); err != nil {
+				log.Printf("client %d could not be pinged: %s", c.id, err)
+				c.Close()
+				return
+			}
+
+		// client was closed
+		case <-c.ctx.Done():
 			return
 		}
 	}
 }
 
 func (c *Client) listenRead() {
-	for {
-		select {
-
-		// receive done request
-		case <-c.doneCh:
-			c.server.Del(c)
-			c.doneCh <- true // for listenWrite method
-			return
-
-		// read data from websocket connection
-		default:
-			var msg JSONMessage
-			err := websocket.JSON.Receive(c.ws, &msg)
-			if err == io.EOF {
-				c.doneCh <- true
-			} else if err != nil {
-				c.server.Err(err)
-			} else {
-				c.AppendNewMessage(NewMessage(&msg.Author, &msg.Body))
-				//broadcasting to same client sockets, excluding self:
-				c.server.Broadcast(c, &msg, true)
-				c.server.SendMatrixMessage(c, msg)
+	defer c.Close()
+	receiver := c.transport.(Receiver)
+	for c.ctx.Err() == nil {
+		var msg JSONMessage
+		var timeout time.Duration
+		if hb := c.server.heartbeat; hb != nil && hb.Interval > 0 {
+			timeout = hb.Timeout
+		}
+		err := receiver.Receive(&msg, timeout)
+		if err != nil {
+			// a malformed frame isn't worth dropping the client for
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+				log.Printf("client %d sent an invalid frame: %s", c.id, err)
+				continue
+			}
+			if c.ctx.Err() == nil {
+				log.Printf("client %d is gone: %s", c.id, err)
 			}
+			return
+		}
+		if ack := c.server.Receive(c, msg); ack != nil {
+			c.Write(ack)
 		}
 	}
 }
@@ -0,0 +1,120 @@
+package chat
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Starts serving a registered client, the returned channel is closed once
+// Listen returns
+func listenTestClient(t *testing.T, s *Server, transport Transport, sessid string) (*Client, <-chan struct{}) {
+	t.Helper()
+	c := NewClient(transport, context.Background(), s, newTestSession(t, sessid, ""))
+	s.registry.Add(c)
+	done := make(chan struct{})
+	go func() {
+		c.Listen()
+		close(done)
+	}()
+	return c, done
+}
+
+func TestClientCloseAndKickConcurrently(t *testing.T) {
+	s := newTestServer(t)
+	transport := newFakeTransport()
+	c, done := listenTestClient(t, s, transport, "close")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch i % 3 {
+			case 0:
+				c.Close()
+			case 1:
+				c.Kick(ClosePolicyViolation, "kicked")
+			default:
+				c.Done()
+			}
+		}(i)
+	}
+	wg.Wait()
+	waitFor(t, done, "Listen to return")
+
+	if n := transport.closeCount(); n != 1 {
+		t.Errorf("transport closed %d times, want 1", n)
+	}
+	if c.ctx.Err() == nil {
+		t.Error("context not cancelled")
+	}
+	if s.registry.Get("close") != nil {
+		t.Error("client still registered")
+	}
+}
+
+func TestClientClosedByReadError(t *testing.T) {
+	s := newTestServer(t)
+	transport := newFakeTransport()
+	c, done := listenTestClient(t, s, transport, "read")
+
+	// the peer goes away, the read goroutine closes the client
+	transport.Close(CloseNormal, "")
+	waitFor(t, done, "Listen to return")
+	<-c.ctx.Done()
+	c.Close()
+
+	if s.registry.Get("read") != nil {
+		t.Error("client still registered")
+	}
+}
+
+func TestServerDelWhileWriting(t *testing.T) {
+	s := newTestServer(t)
+	s.limits = NewClientLimits(4, false, 0, false)
+	transport := newFakeTransport()
+	transport.delay = time.Millisecond
+	c, done := listenTestClient(t, s, transport, "writing")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if i%2 == 0 {
+					c.Write(&JSONMessage{Body: "direct"})
+				} else {
+					s.Broadcast(c, &JSONMessage{Body: "published"}, false)
+				}
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(5 * time.Millisecond)
+		s.Del(c)
+		c.Close()
+	}()
+	wg.Wait()
+	waitFor(t, done, "Listen to return")
+
+	if n := transport.closeCount(); n != 1 {
+		t.Errorf("transport closed %d times, want 1", n)
+	}
+	if s.registry.Get("writing") != nil {
+		t.Error("client still registered")
+	}
+	// writing to a closed client neither blocks nor panics
+	written := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			c.Write(&JSONMessage{Body: "late"})
+		}
+		close(written)
+	}()
+	waitFor(t, written, "writes to a closed client")
+}
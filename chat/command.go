@@ -0,0 +1,278 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// Agents' messages starting with this are commands, never relayed to the
+// visitor
+const commandPrefix = "!"
+
+// An agent's command, written in the room of a session
+type Command struct {
+	Server  *Server
+	Session string
+	Room    mid.RoomID
+	Sender  mid.UserID
+	Name    string
+	Args    []string
+}
+
+// Everything after the command's name
+func (cmd *Command) Text() string {
+	return strings.Join(cmd.Args, " ")
+}
+
+// Answers the agent, in the room
+func (cmd *Command) Reply(format string, args ...interface{}) {
+	cmd.Server.Mautrix_client.SendNotice(cmd.Room, fmt.Sprintf(format, args...))
+}
+
+type CommandHandler struct {
+	Name  string
+	Usage string // arguments, shown by !help
+	Help  string
+	Run   func(cmd *Command) error
+}
+
+// Commands agents may run, by name
+type Commands struct {
+	mutex    sync.RWMutex
+	handlers map[string]*CommandHandler
+}
+
+func NewCommands() *Commands {
+	return &Commands{handlers: make(map[string]*CommandHandler)}
+}
+
+// Adds a command, replacing any of the same name
+func (c *Commands) Register(handler *CommandHandler) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.handlers[handler.Name] = handler
+}
+
+func (c *Commands) Get(name string) *CommandHandler {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.handlers[name]
+}
+
+// Every command, sorted by name
+func (c *Commands) List() []*CommandHandler {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	handlers := make([]*CommandHandler, 0, len(c.handlers))
+	for _, handler := range c.handlers {
+		handlers = append(handlers, handler)
+	}
+	sort.Slice(handlers, func(i, j int) bool { return handlers[i].Name < handlers[j].Name })
+	return handlers
+}
+
+// Runs the command an agent wrote in a session's room. Each event is run at
+// most once, even if a new leader syncs it again
+func (s *Server) runCommand(sessid string, evt *mevent.Event, body string) {
+	fields := strings.Fields(strings.TrimPrefix(body, commandPrefix))
+	if len(fields) == 0 {
+		return
+	}
+	first, err := logCommand(sessid, evt, body)
+	if err != nil {
+		log.Println("Could not log command:", err)
+		return
+	}
+	if !first {
+		return
+	}
+	cmd := &Command{s, sessid, evt.RoomID, evt.Sender, strings.ToLower(fields[0]), fields[1:]}
+	handler := s.commands.Get(cmd.Name)
+	if handler == nil {
+		cmd.Reply("Unknown command %s%s, see %shelp", commandPrefix, cmd.Name, commandPrefix)
+		return
+	}
+	if err := handler.Run(cmd); err != nil {
+		log.Printf("Command %s failed: %s", cmd.Name, err)
+		cmd.Reply("%s%s failed: %s", commandPrefix, cmd.Name, err)
+	}
+}
+
+// Records a command in the Command table, returning false if its event was
+// already recorded
+func logCommand(sessid string, evt *mevent.Event, body string) (bool, error) {
+	var count int
+	row := DB.GetDB().QueryRow("SELECT COUNT(*) FROM Command WHERE event_id = ?", evt.ID.String())
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	_, err := DB.GetDB().Exec("INSERT INTO Command (event_id, session, sender, body, created) VALUES (?, ?, ?, ?, ?)",
+		evt.ID.String(), sessid, evt.Sender.String(), body, time.Now().UTC().Format(TimeFormat))
+	return err == nil, err
+}
+
+// Commands every server has
+func (s *Server) registerCommands() {
+	s.commands.Register(&CommandHandler{"help", "", "lists the commands", helpCommand})
+	s.commands.Register(&CommandHandler{"info", "", "shows who the visitor is and the pages they chatted from", infoCommand})
+	s.commands.Register(&CommandHandler{"close", "", "closes the conversation", closeCommand})
+	s.commands.Register(&CommandHandler{"transfer", "@agent:server [kick]", "hands the conversation to another agent, removing the previous one with kick", transferCommand})
+	s.commands.Register(&CommandHandler{"supervise", "@supervisor:server", "invites a supervisor to the conversation, the visitor isn't told", superviseCommand})
+	s.commands.Register(&CommandHandler{"note", "text", "keeps a note about the conversation, the visitor never sees it", noteCommand})
+	s.commands.Register(&CommandHandler{"canned", "[name]", "sends the visitor a canned response, or lists them", cannedCommand})
+	s.commands.Register(&CommandHandler{"history", "[count]", "shows the last messages of the conversation, 20 by default", historyCommand})
+	s.commands.Register(&CommandHandler{"block", "[ip|email|address|network] [reason]", "blocks the visitor, or their IP or email address", blockCommand})
+	s.commands.Register(&CommandHandler{"unblock", "[ip|email|address|network]", "lifts a block", blockCommand})
+}
+
+func helpCommand(cmd *Command) error {
+	lines := []string{"Commands:"}
+	for _, handler := range cmd.Server.commands.List() {
+		line := commandPrefix + handler.Name
+		if handler.Usage != "" {
+			line += " " + handler.Usage
+		}
+		lines = append(lines, line+": "+handler.Help)
+	}
+	cmd.Reply(strings.Join(lines, "\n"))
+	return nil
+}
+
+func infoCommand(cmd *Command) error {
+	session := NewSession(nil, nil)
+	if err := DB.GetByPk(session, cmd.Session, "session"); err != nil {
+		return err
+	}
+	created := "unknown"
+	if t, err := sessionCreated(*session.Expirity); err == nil {
+		created = t.UTC().Format(TimeFormat)
+	}
+	lines := []string{
+		"Visitor: " + strings.Replace(*session.Alias, "_", " ", 1),
+		"Email: " + *session.Email,
+		"IP address: " + *session.IpAddr,
+		"Since: " + created,
+	}
+	pages, err := LoadPages(cmd.Session, 5)
+	if err != nil {
+		return err
+	}
+	if len(pages) > 0 {
+		lines = append(lines, "Pages:")
+		for _, page := range pages {
+			lines = append(lines, "  "+page)
+		}
+	}
+	cmd.Reply(strings.Join(lines, "\n"))
+	return nil
+}
+
+func closeCommand(cmd *Command) error {
+	cmd.Reply("Conversation closed, leaving the room")
+	return cmd.Server.CloseConversation(cmd.Session, ClosedByAgent)
+}
+
+func transferCommand(cmd *Command) error {
+	if len(cmd.Args) == 0 || len(cmd.Args) > 2 || (len(cmd.Args) == 2 && cmd.Args[1] != "kick") {
+		return fmt.Errorf("usage: %stransfer @agent:server [kick]", commandPrefix)
+	}
+	agent := mid.UserID(cmd.Args[0])
+	if _, _, err := agent.Parse(); err != nil {
+		return fmt.Errorf("%s is not a Matrix ID", agent)
+	}
+	return cmd.Server.Transfer(cmd.Session, agent, cmd.Sender.String(), len(cmd.Args) == 2)
+}
+
+func superviseCommand(cmd *Command) error {
+	if len(cmd.Args) != 1 {
+		return fmt.Errorf("usage: %ssupervise @supervisor:server", commandPrefix)
+	}
+	supervisor := mid.UserID(cmd.Args[0])
+	if _, _, err := supervisor.Parse(); err != nil {
+		return fmt.Errorf("%s is not a Matrix ID", supervisor)
+	}
+	return cmd.Server.Supervise(cmd.Session, supervisor, cmd.Sender.String())
+}
+
+func noteCommand(cmd *Command) error {
+	if len(cmd.Args) == 0 {
+		return fmt.Errorf("usage: %snote text", commandPrefix)
+	}
+	note := &Note{Session: cmd.Session, Author: cmd.Sender.String(), Body: cmd.Text()}
+	if err := note.Create(); err != nil {
+		return err
+	}
+	cmd.Reply("Note kept")
+	return nil
+}
+
+func cannedCommand(cmd *Command) error {
+	if len(cmd.Args) == 0 {
+		list, err := LoadCanned()
+		if err != nil {
+			return err
+		}
+		lines := []string{"Canned responses:"}
+		for _, canned := range list {
+			lines = append(lines, canned.Name+": "+canned.Body)
+		}
+		if len(list) == 0 {
+			lines = []string{"No canned responses yet"}
+		}
+		cmd.Reply(strings.Join(lines, "\n"))
+		return nil
+	}
+	canned, err := FindCanned(cmd.Args[0])
+	if err != nil {
+		return err
+	}
+	if canned == nil {
+		return fmt.Errorf("there's no canned response %s, see %scanned", cmd.Args[0], commandPrefix)
+	}
+	profile := cmd.Server.profiles.Get(cmd.Server.Mautrix_client, cmd.Sender)
+	cmd.Server.sendCanned(cmd.Session, cmd.Room, canned.Body, false, profile)
+	cmd.Server.assignConversation(cmd.Session, cmd.Sender)
+	return nil
+}
+
+func historyCommand(cmd *Command) error {
+	count := 20
+	if len(cmd.Args) > 0 {
+		n, err := strconv.Atoi(cmd.Args[0])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("usage: %shistory [count]", commandPrefix)
+		}
+		count = n
+	}
+	messages, err := LoadMessages(cmd.Session)
+	if err != nil {
+		return err
+	}
+	if len(messages) > count {
+		messages = messages[len(messages)-count:]
+	}
+	lines := []string{}
+	for _, msg := range messages {
+		author := *msg.Author
+		if author == "0" {
+			author = "agent"
+		}
+		lines = append(lines, fmt.Sprintf("[%s] %s: %s", *msg.Created, author, *msg.Body))
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "No messages yet")
+	}
+	cmd.Reply(strings.Join(lines, "\n"))
+	return nil
+}
@@ -0,0 +1,105 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// An agent's message in the session's room
+func agentEvent(eventID, body string) *mevent.Event {
+	return &mevent.Event{
+		ID:      mid.EventID(eventID),
+		Type:    mevent.EventMessage,
+		RoomID:  "!room:example.org",
+		Sender:  "@agent:example.org",
+		Content: mevent.Content{Parsed: &mevent.MessageEventContent{MsgType: mevent.MsgText, Body: body}},
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		reply string
+	}{
+		{"help", "!help", "!transfer @agent:server [kick]: hands the conversation"},
+		{"case insensitive", "!HELP", "Commands:"},
+		{"unknown", "!frobnicate now", "Unknown command !frobnicate, see !help"},
+		{"failing", "!transfer nobody", "!transfer failed: nobody is not a Matrix ID"},
+		{"usage", "!note", "!note failed: usage: !note text"},
+		{"info", "!info", "Visitor: Ada Lovelace"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			hs := newFakeHomeserver(t, s)
+			newTestSession(t, "visitor", "!room:example.org")
+
+			s.runCommand("visitor", agentEvent("$command", test.body), test.body)
+			if len(hs.sent(test.reply)) != 1 {
+				t.Errorf("no reply %q, sent %v", test.reply, hs.sent("m.notice"))
+			}
+			if n := countRows(t, "SELECT COUNT(*) FROM Command WHERE event_id = '$command' AND session = 'visitor'"); n != 1 {
+				t.Errorf("%d commands logged, want 1", n)
+			}
+		})
+	}
+}
+
+func TestRunCommandOnce(t *testing.T) {
+	s := newTestServer(t)
+	newFakeHomeserver(t, s)
+	newTestSession(t, "visitor", "!room:example.org")
+
+	// synced again by a new leader
+	for i := 0; i < 2; i++ {
+		s.runCommand("visitor", agentEvent("$note", "!note owes us money"), "!note owes us money")
+	}
+	notes, err := LoadNotes("visitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Body != "owes us money" || notes[0].Author != "@agent:example.org" {
+		t.Errorf("notes %+v, want the one note", notes)
+	}
+}
+
+func TestRegisteredCommand(t *testing.T) {
+	s := newTestServer(t)
+	hs := newFakeHomeserver(t, s)
+	newTestSession(t, "visitor", "!room:example.org")
+	var got *Command
+	s.Commands().Register(&CommandHandler{"echo", "text", "repeats the text", func(cmd *Command) error {
+		got = cmd
+		cmd.Reply("echo: %s", cmd.Text())
+		return nil
+	}})
+
+	s.runCommand("visitor", agentEvent("$echo", "!echo  hello   world "), "!echo  hello   world ")
+	if got == nil || got.Session != "visitor" || got.Sender != "@agent:example.org" || strings.Join(got.Args, ",") != "hello,world" {
+		t.Fatalf("ran %+v", got)
+	}
+	if len(hs.sent("echo: hello world")) != 1 {
+		t.Error("no reply")
+	}
+}
+
+func TestCloseCommand(t *testing.T) {
+	s := newTestServer(t)
+	hs := newFakeHomeserver(t, s)
+	newTestSession(t, "visitor", "!room:example.org")
+
+	s.runCommand("visitor", agentEvent("$close", "!close"), "!close")
+	if conv, err := CurrentConversation("visitor"); err != nil || conv != nil {
+		t.Errorf("conversation %+v left open: %v", conv, err)
+	}
+	if room, err := RoomBySession("visitor"); err != nil || room != "" {
+		t.Errorf("session still in %q: %v", room, err)
+	}
+	if len(hs.sent("/leave")) != 1 {
+		t.Error("the bot didn't leave the room")
+	}
+}
@@ -0,0 +1,199 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+// States of a conversation. It's open until its room is created, or queued
+// while every agent is busy, waiting until an agent answers, then assigned to
+// that agent until it's closed
+const (
+	StateOpen     = "open"
+	StateQueued   = "queued"
+	StateWaiting  = "waiting"
+	StateAssigned = "assigned"
+	StateClosed   = "closed"
+)
+
+// Who closed a conversation
+const (
+	ClosedByAgent      = "agent"
+	ClosedByVisitor    = "visitor"
+	ClosedByInactivity = "inactivity"
+)
+
+// One conversation of a session, in one room. Once it's closed, the next
+// message of the visitor starts another one, in a new room
+type Conversation struct {
+	Id       int
+	Session  string
+	Room     string
+	State    string
+	Agent    string // Matrix ID of the agent it's assigned to
+	Opened   string
+	Closed   string
+	ClosedBy string
+}
+
+func NewConversation(sessid string) *Conversation {
+	return &Conversation{Session: sessid, State: StateOpen, Opened: time.Now().UTC().Format(TimeFormat)}
+}
+
+func (c *Conversation) Create() error {
+	res, err := DB.GetDB().Exec("INSERT INTO Conversation (session, room, state, agent, opened, closed, closed_by) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		c.Session, c.Room, c.State, c.Agent, c.Opened, c.Closed, c.ClosedBy)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	c.Id = int(id)
+	return err
+}
+
+func (c *Conversation) Save() error {
+	_, err := DB.GetDB().Exec("UPDATE Conversation SET room = ?, state = ?, agent = ?, closed = ?, closed_by = ? WHERE id = ?",
+		c.Room, c.State, c.Agent, c.Closed, c.ClosedBy, c.Id)
+	return err
+}
+
+// The conversation of the session which isn't closed yet, nil if there's
+// none. Sessions given a room before conversations existed get one
+func CurrentConversation(sessid string) (*Conversation, error) {
+	conv, err := findConversation("session = ? AND state != ? ORDER BY id DESC", sessid, StateClosed)
+	if err != nil || conv != nil {
+		return conv, err
+	}
+	room, err := RoomBySession(sessid)
+	if err != nil || room == "" {
+		return nil, err
+	}
+	conv = NewConversation(sessid)
+	conv.Room = room.String()
+	conv.State = StateWaiting
+	return conv, conv.Create()
+}
+
+// The conversation held in a room, nil if there's none
+func ConversationByRoom(room mid.RoomID) (*Conversation, error) {
+	return findConversation("room = ? ORDER BY id DESC", room.String())
+}
+
+func findConversation(where string, args ...interface{}) (*Conversation, error) {
+	c := &Conversation{}
+	row := DB.GetDB().QueryRow("SELECT id, session, room, state, agent, opened, closed, closed_by FROM Conversation WHERE "+where+" LIMIT 1", args...)
+	err := row.Scan(&c.Id, &c.Session, &c.Room, &c.State, &c.Agent, &c.Opened, &c.Closed, &c.ClosedBy)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Assigns the session's conversation to the agent answering it, unless it's
+// already assigned
+func (s *Server) assignConversation(sessid string, agent mid.UserID) {
+	conv, err := CurrentConversation(sessid)
+	if err != nil || conv == nil || conv.State == StateAssigned {
+		return
+	}
+	conv.State = StateAssigned
+	conv.Agent = agent.String()
+	if err := conv.Save(); err != nil {
+		log.Println("Could not assign conversation:", err)
+	}
+}
+
+// Closes the session's conversation: the visitor is told, the room is renamed
+// and left by the bot, and the session has no room until the visitor writes
+// again
+func (s *Server) CloseConversation(sessid, by string) error {
+	conv, err := CurrentConversation(sessid)
+	if err != nil {
+		return err
+	}
+	if conv == nil {
+		return fmt.Errorf("the conversation is already closed")
+	}
+	conv.State = StateClosed
+	conv.Closed = time.Now().UTC().Format(TimeFormat)
+	conv.ClosedBy = by
+	if err := conv.Save(); err != nil {
+		return err
+	}
+	if _, err := DB.GetDB().Exec("UPDATE Session SET RoomID = '' WHERE session = ?", sessid); err != nil {
+		return err
+	}
+	s.publish(&SessionEvent{Session: sessid, Closed: conv.Room, Frame: &JSONMessage{Type: FrameClosed, Body: by}})
+
+	if room := mid.RoomID(conv.Room); room != "" {
+		name := "Closed conversation"
+		session := NewSession(nil, nil)
+		if err := DB.GetByPk(session, sessid, "session"); err == nil && *session.Alias != "" {
+			name += " with " + strings.Replace(*session.Alias, "_", " ", 1)
+		}
+		topic := fmt.Sprintf("Closed by the %s on %s UTC", by, conv.Closed)
+		s.Mautrix_client.ArchiveRoom(room, name, topic)
+	}
+	return nil
+}
+
+// Closes, once every interval, the conversations in which nobody wrote for
+// idle. Only the leader does. Zero idle keeps them open forever
+func (s *Server) CloseIdle(idle time.Duration) {
+	if idle <= 0 {
+		return
+	}
+	interval := idle / 4
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !s.Mautrix_client.IsLeader() {
+			continue
+		}
+		sessions, err := idleConversations(time.Now().Add(-idle))
+		if err != nil {
+			log.Println("Could not list idle conversations:", err)
+			continue
+		}
+		for _, sessid := range sessions {
+			if err := s.CloseConversation(sessid, ClosedByInactivity); err != nil {
+				log.Printf("Could not close the conversation of %s: %s", sessid, err)
+			}
+		}
+	}
+}
+
+// Sessions whose conversation saw no message since before
+func idleConversations(before time.Time) ([]string, error) {
+	cutoff := before.UTC().Format(TimeFormat)
+	rows, err := DB.GetDB().Query(`SELECT c.session FROM Conversation c
+		LEFT JOIN Message m ON m.session = c.session
+		WHERE c.state != ?
+		GROUP BY c.session
+		HAVING MAX(c.opened) < ? AND (MAX(m.created) IS NULL OR MAX(m.created) < ?)`,
+		StateClosed, cutoff, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	idle := []string{}
+	for rows.Next() {
+		var sessid string
+		if err := rows.Scan(&sessid); err != nil {
+			return nil, err
+		}
+		idle = append(idle, sessid)
+	}
+	return idle, rows.Err()
+}
@@ -0,0 +1,38 @@
+package chat
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestIdleConversations(t *testing.T) {
+	newTestServer(t)
+	now := time.Now()
+	conversation := func(sessid, state string, opened time.Time) {
+		t.Helper()
+		conv := NewConversation(sessid)
+		conv.State = state
+		conv.Opened = opened.UTC().Format(TimeFormat)
+		if err := conv.Create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conversation("quiet", StateAssigned, now.Add(-time.Hour))
+	newRetainedMessage(t, "quiet", "hello", "$quiet", now.Add(-50*time.Minute))
+	conversation("talking", StateAssigned, now.Add(-time.Hour))
+	newRetainedMessage(t, "talking", "hello", "$talking-1", now.Add(-50*time.Minute))
+	newRetainedMessage(t, "talking", "still there?", "$talking-2", now.Add(-time.Minute))
+	conversation("silent", StateWaiting, now.Add(-time.Hour))
+	conversation("new", StateOpen, now.Add(-time.Minute))
+	conversation("closed", StateClosed, now.Add(-time.Hour))
+
+	idle, err := idleConversations(now.Add(-30 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(idle)
+	if len(idle) != 2 || idle[0] != "quiet" || idle[1] != "silent" {
+		t.Errorf("idle conversations %v, want quiet and silent", idle)
+	}
+}
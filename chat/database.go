@@ -12,8 +12,8 @@ import (
 	"strings"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
 )
 
 var DB Database
@@ -70,7 +70,9 @@ func ConnectSQL(name, password, database, ip_addr, port, dbtype, dbfile string)
 			return nil, err
 		}
 		dbase.Close()
-		dbase, err = sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", name, password, ip_addr, port, database))
+		// rows matched rather than changed, so renewing the leader lease within
+		// the same second still counts
+		dbase, err = sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?clientFoundRows=true", name, password, ip_addr, port, database))
 		if err != nil {
 			log.Printf("Error %s using DB\n", err)
 			return nil, err
@@ -88,6 +90,21 @@ func ConnectSQL(name, password, database, ip_addr, port, dbtype, dbfile string)
 	return db, nil
 }
 
+// Whether err is a unique constraint violation or a deadlock, which a
+// concurrent transaction may have caused and retrying may get past
+func isConflict(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// ER_DUP_ENTRY and ER_LOCK_DEADLOCK
+		return mysqlErr.Number == 1062 || mysqlErr.Number == 1213
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrConstraint || sqliteErr.Code == sqlite3.ErrBusy
+	}
+	return false
+}
+
 // Useful to produce a slice of interface{} values, from a slice of string vals
 // particularly  to pass as variadic parameters to Query , Exec or similar func
 func interfaceSlice(strlst []string) []interface{} {
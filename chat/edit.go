@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"log"
+	"strings"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// Handles an edit or delete frame of the visitor, about one of their own
+// messages. The edit is relayed to Matrix as a replacement event, the deletion
+// as a redaction, and both to the session's other sockets
+func (s *Server) receiveEdit(c *Client, msg JSONMessage) *JSONMessage {
+	sessid := *c.session.SessionId
+	target, err := MessageBySeq(sessid, msg.Ref)
+	if err != nil {
+		log.Println("Could not look up message:", err)
+		return nil
+	}
+	// agents' messages are written as "0", and deleted ones have no body
+	if target == nil || *target.Author == "0" || *target.Body == "" {
+		log.Printf("client %d cannot edit message %d", c.id, msg.Ref)
+		return nil
+	}
+	if msg.Type == FrameEdit && msg.Body == "" {
+		return nil
+	}
+	if msg.Type == FrameDelete {
+		msg.Body = ""
+	}
+	if err := target.SetBody(msg.Body, ""); err != nil {
+		log.Println("Could not store edit:", err)
+		return nil
+	}
+
+	if eventID := mid.EventID(*target.EventID); eventID != "" {
+		if room, err := s.roomOfMessage(c, target); err != nil {
+			log.Println("Could not relay edit:", err)
+		} else if msg.Type == FrameDelete {
+			s.Mautrix_client.RedactEvent(room, eventID, "deleted by the visitor")
+		} else if room != s.inbox.Room { // the offline inbox keeps messages as they were left
+			content := s.formatting.VisitorContent(msg.Body)
+			content.SetEdit(eventID)
+			s.Mautrix_client.SendMessage(room, &content, "")
+		}
+	}
+
+	frame := &JSONMessage{Type: msg.Type, Ref: target.Seq, Author: *target.Author, Body: msg.Body}
+	s.publish(&SessionEvent{Session: sessid, Exclude: c.id, Frame: frame, Update: target})
+	return &JSONMessage{Type: FrameAck, ID: msg.ID, Ref: target.Seq}
+}
+
+// Relays an agent's edit of a message to the session's sockets
+func (s *Server) routeEdit(sessid string, evt *mevent.Event, original mid.EventID) {
+	content := evt.Content.AsMessage()
+	body := strings.TrimPrefix(content.Body, "* ")
+	html := ""
+	if content.NewContent != nil {
+		body = content.NewContent.Body
+		html = AgentHTML(content.NewContent)
+	}
+	s.updateRouted(sessid, evt.Sender, original, FrameEdit, body, html)
+}
+
+// Relays the redaction of a message or a reaction, by an agent, to the
+// session's sockets
+func (s *Server) routeRedaction(sessid string, evt *mevent.Event) {
+	if s.routeUnreact(sessid, evt.Redacts) {
+		return
+	}
+	s.updateRouted(sessid, evt.Sender, evt.Redacts, FrameDelete, "", "")
+}
+
+// Applies an agent's edit or redaction to the message they wrote. Matrix
+// clients ignore edits of someone else's message, so does the widget, for
+// visitors' messages and the bot's replies as well
+func (s *Server) updateRouted(sessid string, sender mid.UserID, eventID mid.EventID, frameType, body, html string) {
+	target, err := MessageByEvent(eventID)
+	if err != nil {
+		log.Println("Could not look up message:", err)
+		return
+	}
+	// replayed by a new leader, or about a message the visitor never got
+	if target == nil || *target.Session != sessid || (*target.Body == body && *target.HTML == html) {
+		return
+	}
+	// purged messages stay purged
+	if *target.Body == "" {
+		return
+	}
+	if *target.Sender == "" || *target.Sender != sender.String() {
+		log.Printf("%s cannot edit message %d of %s", sender, target.Seq, sessid)
+		return
+	}
+	if err := target.SetBody(body, html); err != nil {
+		log.Println("Could not store edit:", err)
+		return
+	}
+	frame := &JSONMessage{Type: frameType, Ref: target.Seq, Author: *target.Author, Body: body, HTML: html}
+	s.publish(&SessionEvent{Session: sessid, Frame: frame, Update: target})
+}
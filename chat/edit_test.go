@@ -0,0 +1,50 @@
+package chat
+
+import (
+	"testing"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+func TestUpdateRoutedOnlyBySender(t *testing.T) {
+	agent := mid.UserID("@agent:example.org")
+	tests := []struct {
+		name   string
+		author string
+		sender mid.UserID
+		auto   bool
+		body   string
+		by     mid.UserID
+		edited bool
+	}{
+		{"own message", "0", agent, false, "hello", agent, true},
+		{"another agent's message", "0", agent, false, "hello", "@other:example.org", false},
+		{"visitor's message", "Ada_Lovelace", "", false, "hello", agent, false},
+		{"bot's reply", "0", "", true, "hello", agent, false},
+		{"purged message", "0", agent, false, "", agent, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			newTestSession(t, "visitor", "!room:example.org")
+			msg := NewMessage(&test.author, &test.body)
+			*msg.Session = "visitor"
+			*msg.EventID = "$original"
+			*msg.Sender = test.sender.String()
+			msg.Auto = test.auto
+			if err := msg.Create(); err != nil {
+				t.Fatal(err)
+			}
+
+			s.updateRouted("visitor", test.by, "$original", FrameEdit, "edited", "")
+
+			stored, err := MessageByEvent("$original")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if edited := *stored.Body == "edited"; edited != test.edited {
+				t.Errorf("body %q, edited %v, want %v", *stored.Body, edited, test.edited)
+			}
+		})
+	}
+}
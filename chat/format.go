@@ -0,0 +1,170 @@
+package chat
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	mevent "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+// How visitors' text reaches agents. By default it's sent as plain text,
+// otherwise it's rendered as Markdown, without raw HTML, and the result is
+// sanitized. Links are only kept if allowed, else just their text is
+type Formatting struct {
+	VisitorMarkdown bool
+	VisitorLinks    bool
+}
+
+func NewFormatting(markdown, links bool) *Formatting {
+	return &Formatting{markdown, links}
+}
+
+// The Matrix message content a visitor's text is relayed as
+func (f *Formatting) VisitorContent(body string) mevent.MessageEventContent {
+	if f == nil || !f.VisitorMarkdown {
+		return mevent.MessageEventContent{MsgType: mevent.MsgText, Body: body}
+	}
+	content := format.RenderMarkdown(body, true, false)
+	if content.FormattedBody != "" {
+		content.FormattedBody = SanitizeHTML(content.FormattedBody, f.VisitorLinks)
+	}
+	return content
+}
+
+// The sanitized HTML of an agent's message, empty if it has none. Agents'
+// links are kept
+func AgentHTML(content *mevent.MessageEventContent) string {
+	if content.Format != mevent.FormatHTML || content.FormattedBody == "" {
+		return ""
+	}
+	return SanitizeHTML(mevent.TrimReplyFallbackHTML(content.FormattedBody), true)
+}
+
+// Elements kept by SanitizeHTML, the subset of what the Matrix specification
+// suggests clients render which is safe in the widget
+var allowedTags = map[string]bool{
+	"a": true, "b": true, "blockquote": true, "br": true, "caption": true,
+	"code": true, "del": true, "div": true, "em": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "hr": true, "i": true,
+	"li": true, "ol": true, "p": true, "pre": true, "s": true, "span": true,
+	"strike": true, "strong": true, "sub": true, "sup": true, "table": true,
+	"tbody": true, "td": true, "th": true, "thead": true, "tr": true,
+	"u": true, "ul": true,
+}
+
+// Elements dropped along with everything inside them
+var droppedTags = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true,
+	"embed": true, "noscript": true, "template": true, "textarea": true,
+	"title": true, "mx-reply": true,
+}
+
+var voidTags = map[string]bool{"br": true, "hr": true}
+
+var (
+	languagePattern = regexp.MustCompile(`^language-[A-Za-z0-9_+-]{1,32}$`)
+	colorPattern    = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+	numberPattern   = regexp.MustCompile(`^[0-9]{1,6}$`)
+)
+
+// Keeps only allowed elements and attributes of the HTML, links only if the
+// flag says so, and always balances the tags left
+func SanitizeHTML(input string, links bool) string {
+	var out strings.Builder
+	z := html.NewTokenizer(strings.NewReader(input))
+	open := []string{}
+	skip := 0 // depth within dropped elements
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			for i := len(open) - 1; i >= 0; i-- {
+				out.WriteString("</" + open[i] + ">")
+			}
+			return out.String()
+
+		case html.TextToken:
+			if skip == 0 {
+				out.WriteString(html.EscapeString(string(z.Text())))
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if droppedTags[tok.Data] {
+				if tt == html.StartTagToken {
+					skip++
+				}
+				continue
+			}
+			if skip > 0 || !allowedTags[tok.Data] || (tok.Data == "a" && !links) {
+				continue
+			}
+			out.WriteString("<" + tok.Data)
+			for _, attr := range sanitizeAttrs(tok) {
+				out.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+			}
+			out.WriteString(">")
+			if !voidTags[tok.Data] {
+				open = append(open, tok.Data)
+			}
+
+		case html.EndTagToken:
+			tok := z.Token()
+			if droppedTags[tok.Data] {
+				if skip > 0 {
+					skip--
+				}
+				continue
+			}
+			if skip > 0 {
+				continue
+			}
+			// closes whatever was left open within it too
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == tok.Data {
+					for j := len(open) - 1; j >= i; j-- {
+						out.WriteString("</" + open[j] + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+		}
+	}
+}
+
+func sanitizeAttrs(tok html.Token) []html.Attribute {
+	attrs := []html.Attribute{}
+	for _, attr := range tok.Attr {
+		switch {
+		case tok.Data == "a" && attr.Key == "href":
+			if u, err := url.Parse(attr.Val); err == nil {
+				switch strings.ToLower(u.Scheme) {
+				case "http", "https", "mailto":
+					attrs = append(attrs, attr)
+				}
+			}
+		case tok.Data == "code" && attr.Key == "class":
+			if languagePattern.MatchString(attr.Val) {
+				attrs = append(attrs, attr)
+			}
+		case tok.Data == "ol" && attr.Key == "start":
+			if numberPattern.MatchString(attr.Val) {
+				attrs = append(attrs, attr)
+			}
+		case attr.Key == "data-mx-color" || attr.Key == "data-mx-bg-color":
+			if colorPattern.MatchString(attr.Val) {
+				attrs = append(attrs, attr)
+			}
+		}
+	}
+	if tok.Data == "a" {
+		attrs = append(attrs,
+			html.Attribute{Key: "target", Val: "_blank"},
+			html.Attribute{Key: "rel", Val: "noopener noreferrer nofollow"})
+	}
+	return attrs
+}
@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"testing"
+
+	mevent "maunium.net/go/mautrix/event"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain text", "a < b & c", "a &lt; b &amp; c"},
+		{"allowed tags", "<p><b>bold</b> <em>em</em></p>", "<p><b>bold</b> <em>em</em></p>"},
+		{"unknown tag", "<img src=x onerror=alert(1)>text", "text"},
+		{"event handler", `<b onclick="alert(1)">bold</b>`, "<b>bold</b>"},
+		{"unclosed tags", "<b><i>text", "<b><i>text</i></b>"},
+		{"misnested tags", "<b><i>text</b>more</i>", "<b><i>text</i></b>more"},
+		{"stray end tag", "text</b></p>", "text"},
+
+		{"http link", `<a href="https://example.org/">site</a>`,
+			`<a href="https://example.org/" target="_blank" rel="noopener noreferrer nofollow">site</a>`},
+		{"mailto link", `<a href="mailto:ada@example.org">mail</a>`,
+			`<a href="mailto:ada@example.org" target="_blank" rel="noopener noreferrer nofollow">mail</a>`},
+		{"javascript href", `<a href="javascript:alert(1)">x</a>`,
+			`<a target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"uppercase javascript href", `<a href="JavaScript:alert(1)">x</a>`,
+			`<a target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"data href", `<a href="data:text/html;base64,PHNjcmlwdD4=">x</a>`,
+			`<a target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"vbscript href", `<a href="vbscript:msgbox(1)">x</a>`,
+			`<a target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"entity-encoded scheme", `<a href="jav&#x61;script:alert(1)">x</a>`,
+			`<a target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"entity-encoded colon", `<a href="javascript&colon;alert(1)">x</a>`,
+			`<a target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"decimal entities", `<a href="&#106;&#97;vascript:alert(1)">x</a>`,
+			`<a target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"tab in scheme", "<a href=\"java\tscript:alert(1)\">x</a>",
+			`<a target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"leading space", `<a href=" javascript:alert(1)">x</a>`,
+			`<a target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"own target", `<a href="https://example.org/" target="_self">x</a>`,
+			`<a href="https://example.org/" target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+
+		{"quote breakout", `<a href="https://example.org/&quot; onmouseover=&quot;alert(1)">x</a>`,
+			`<a href="https://example.org/&#34; onmouseover=&#34;alert(1)" target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"single quote breakout", `<a href='https://example.org/" onmouseover="alert(1)'>x</a>`,
+			`<a href="https://example.org/&#34; onmouseover=&#34;alert(1)" target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+		{"script after attribute", `<code class="language-go"><script>">x</code>`, `<code class="language-go"></code>`},
+		{"bad language class", `<code class="language-go onclick">x</code>`, "<code>x</code>"},
+		{"language class", `<code class="language-go">x</code>`, `<code class="language-go">x</code>`},
+		{"color", `<span data-mx-color="#ff0000">red</span>`, `<span data-mx-color="#ff0000">red</span>`},
+		{"bad color", `<span data-mx-color="red;background:url(x)">red</span>`, "<span>red</span>"},
+		{"list start", `<ol start="3"><li>c</li></ol>`, `<ol start="3"><li>c</li></ol>`},
+		{"bad list start", `<ol start="-1"><li>c</li></ol>`, `<ol><li>c</li></ol>`},
+
+		{"script", "a<script>alert(1)</script>b", "ab"},
+		{"style", "a<style>body{display:none}</style>b", "ab"},
+		{"unclosed script", "a<script>alert(1)<b>b</b>", "a"},
+		{"unclosed style", "<p>a<style>p{}", "<p>a</p>"},
+		{"script in script", "a<script><script>alert(1)</script>b</script>c", "abc"},
+		{"script in iframe", "a<iframe><script>alert(1)</script></iframe>b", "ab"},
+		{"nested dropped tags", "a<object><embed>x</embed><noscript>y</noscript></object>b", "ab"},
+		{"self-closing script", "a<script/>b", "ab"},
+		{"script end in attribute", `a<script data-x="</script>">alert(1)</script>b`, "ab"},
+		{"script inside allowed tag", "<b>a<script>alert(1)</script>b</b>", "<b>ab</b>"},
+		{"unmatched script end", "a</script>b", "ab"},
+
+		{"reply fallback", "<mx-reply><blockquote>quoted</blockquote></mx-reply>answer", "answer"},
+		{"unclosed reply fallback", "<mx-reply><blockquote>quoted", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := SanitizeHTML(test.input, true); got != test.want {
+				t.Errorf("SanitizeHTML(%q) = %q, want %q", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeHTMLWithoutLinks(t *testing.T) {
+	input := `see <a href="https://example.org/">the <b>site</b></a>`
+	want := "see the <b>site</b>"
+	if got := SanitizeHTML(input, false); got != want {
+		t.Errorf("SanitizeHTML(%q) = %q, want %q", input, got, want)
+	}
+}
+
+func TestAgentHTMLStripsReply(t *testing.T) {
+	content := &mevent.MessageEventContent{
+		MsgType:       mevent.MsgText,
+		Body:          "> <@ada:example.org> quoted\n\nanswer",
+		Format:        mevent.FormatHTML,
+		FormattedBody: `<mx-reply><blockquote><a href="https://matrix.to/#/@ada:example.org">Ada</a> quoted</blockquote></mx-reply><b>answer</b>`,
+	}
+	if got := AgentHTML(content); got != "<b>answer</b>" {
+		t.Errorf("AgentHTML = %q, want the reply fallback stripped", got)
+	}
+}
+
+func TestVisitorContent(t *testing.T) {
+	plain := NewFormatting(false, false).VisitorContent("**hi** <script>alert(1)</script>")
+	if plain.FormattedBody != "" || plain.Body != "**hi** <script>alert(1)</script>" {
+		t.Errorf("plain content %+v, want the text as is", plain)
+	}
+
+	markdown := NewFormatting(true, false).VisitorContent("**hi** [site](javascript:alert(1)) <script>alert(1)</script>")
+	if markdown.FormattedBody != "<strong>hi</strong> site &lt;script&gt;alert(1)&lt;/script&gt;" {
+		t.Errorf("markdown content %q", markdown.FormattedBody)
+	}
+}
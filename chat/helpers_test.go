@@ -0,0 +1,159 @@
+package chat
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+)
+
+// Server backed by a fresh SQLite database and in memory pub/sub, without a
+// Matrix connection
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	db, err := ConnectSQL("", "", "", "", "", "sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.GetDB().Close() })
+	if err := NewStateStore(db.GetDB()).CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	pubsub := NewMemoryPubSub()
+	s := NewServer("/entry", false, nil, NewClientLimits(0, false, 0, false), NewFormatting(false, false),
+		NewRateLimits(0, 0, 0, 0), NewRouting(nil, "", 0), NewOfflineInbox(""), nil, NewQueue(0),
+		NewProfiles(nil, false), nil, "//", pubsub, NewApp("0", false, db, nil))
+	if err := pubsub.Subscribe(sessionTopic, s.deliver); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Stores a session, with a room if room isn't empty
+func newTestSession(t *testing.T, sessid, room string) *Session {
+	t.Helper()
+	_, err := DB.GetDB().Exec("INSERT INTO Session (session, expirity, alias, email, ip, RoomID) VALUES (?, '', ?, '', '192.0.2.1', ?)",
+		sessid, "Ada_Lovelace", room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewSession(nil, nil)
+	if err := DB.GetByPk(session, sessid, "session"); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+// Transport recording what it's given. Its reads block until it's closed
+type fakeTransport struct {
+	mutex  sync.Mutex
+	sent   []*JSONMessage
+	closes int
+	closed chan struct{}
+	delay  time.Duration // of each send
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{closed: make(chan struct{})}
+}
+
+func (t *fakeTransport) Send(msg *JSONMessage) error {
+	time.Sleep(t.delay)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sent = append(t.sent, msg)
+	return nil
+}
+
+func (t *fakeTransport) Ping() error {
+	return nil
+}
+
+func (t *fakeTransport) Close(code int, reason string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closes++
+	if t.closes == 1 {
+		close(t.closed)
+	}
+	return nil
+}
+
+func (t *fakeTransport) Receive(msg *JSONMessage, timeout time.Duration) error {
+	<-t.closed
+	return io.EOF
+}
+
+func (t *fakeTransport) closeCount() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.closes
+}
+
+// Fails the test unless done is closed soon
+func waitFor(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// Homeserver recording the requests it's sent, and answering each with an
+// event and a room ID
+type fakeHomeserver struct {
+	mutex    sync.Mutex
+	requests []string // method, path and body
+}
+
+// Points the server's bot at a new fake homeserver
+func newFakeHomeserver(t *testing.T, s *Server) *fakeHomeserver {
+	t.Helper()
+	hs := &fakeHomeserver{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		hs.mutex.Lock()
+		hs.requests = append(hs.requests, r.Method+" "+r.URL.Path+" "+string(body))
+		hs.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"event_id": "$fake", "room_id": "!fake:example.org"}`)
+	}))
+	t.Cleanup(ts.Close)
+	client, err := mautrix.NewClient(ts.URL, "@bot:example.org", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Mautrix_client.client = client
+	return hs
+}
+
+// Requests whose method, path or body contains part
+func (hs *fakeHomeserver) sent(part string) []string {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	found := []string{}
+	for _, req := range hs.requests {
+		if strings.Contains(req, part) {
+			found = append(found, req)
+		}
+	}
+	return found
+}
+
+// Fails the test unless cond holds soon
+func eventually(t *testing.T, cond func() bool, what string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,286 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Weekly business hours in a time zone, minus holidays. Outside of them the
+// widget is told when agents will answer, and the bot marks new rooms
+type BusinessHours struct {
+	location     *time.Location
+	week         [7][]span // by weekday
+	holidays     []holiday
+	Message      string // shown by the widget outside business hours
+	ResponseTime string // when agents will answer, shown after Message
+}
+
+// Minutes since midnight, to excluded
+type span struct {
+	from, to int
+}
+
+// Days off from an iCalendar file, to excluded
+type holiday struct {
+	summary  string
+	from, to time.Time
+	yearly   bool
+}
+
+// Business hours of an empty spec, every day but holidays
+const alwaysOpen = "mon-sun 00:00-24:00"
+
+// Parses business hours such as "mon-fri 09:00-12:00,13:00-17:00; sat
+// 10:00-13:00", in the time zone, minus the holidays of the iCalendar file if
+// any. An empty spec is always open but on holidays, and without them nil is
+// returned
+func ParseBusinessHours(spec, zone, holidays, message, responseTime string) (*BusinessHours, error) {
+	if strings.TrimSpace(spec) == "" {
+		if holidays == "" {
+			return nil, nil
+		}
+		spec = alwaysOpen
+	}
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, err
+	}
+	h := &BusinessHours{location: location, Message: message, ResponseTime: responseTime}
+	for _, entry := range strings.Split(spec, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%q should be days and hours", strings.TrimSpace(entry))
+		}
+		days, err := parseDays(strings.ToLower(fields[0]))
+		if err != nil {
+			return nil, err
+		}
+		for _, hours := range strings.Split(fields[1], ",") {
+			s, err := parseSpan(hours)
+			if err != nil {
+				return nil, err
+			}
+			for _, day := range days {
+				h.week[day] = append(h.week[day], s)
+			}
+		}
+	}
+	if err := h.loadHolidays(holidays); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Parses "mon", "mon-fri" or "sat-sun"
+func parseDays(days string) ([]time.Weekday, error) {
+	bounds := strings.SplitN(days, "-", 2)
+	first, ok := weekdays[bounds[0]]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a day", bounds[0])
+	}
+	last := first
+	if len(bounds) == 2 {
+		if last, ok = weekdays[bounds[1]]; !ok {
+			return nil, fmt.Errorf("%s is not a day", bounds[1])
+		}
+	}
+	list := []time.Weekday{first}
+	for day := first; day != last; {
+		day = (day + 1) % 7
+		list = append(list, day)
+	}
+	return list, nil
+}
+
+// Parses "09:00-17:00", where "24:00" is midnight at the end of the day
+func parseSpan(hours string) (span, error) {
+	bounds := strings.SplitN(hours, "-", 2)
+	if len(bounds) != 2 {
+		return span{}, fmt.Errorf("%s should be from-to", hours)
+	}
+	var s span
+	for i, bound := range bounds {
+		var hh, mm int
+		if _, err := fmt.Sscanf(bound, "%d:%d", &hh, &mm); err != nil || hh < 0 || hh > 24 || mm < 0 || mm > 59 || hh*60+mm > 24*60 {
+			return span{}, fmt.Errorf("%s is not a time of day", bound)
+		}
+		if i == 0 {
+			s.from = hh*60 + mm
+		} else {
+			s.to = hh*60 + mm
+		}
+	}
+	if s.to <= s.from {
+		return span{}, fmt.Errorf("%s ends before it starts", hours)
+	}
+	return s, nil
+}
+
+// Imports the events of an iCalendar file as holidays. Events repeating
+// yearly are holidays every year, other rules are ignored
+func (h *BusinessHours) loadHolidays(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// long lines are folded, continuation lines start with a space or a tab
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var event *holiday
+	for _, line := range lines {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		name, value := line[:colon], line[colon+1:]
+		params := strings.Split(name, ";")
+		switch strings.ToUpper(params[0]) {
+		case "BEGIN":
+			if strings.EqualFold(value, "VEVENT") {
+				event = &holiday{}
+			}
+		case "END":
+			if strings.EqualFold(value, "VEVENT") && event != nil {
+				if !event.from.IsZero() {
+					if event.to.IsZero() {
+						event.to = event.from.AddDate(0, 0, 1)
+					}
+					h.holidays = append(h.holidays, *event)
+				}
+				event = nil
+			}
+		case "SUMMARY":
+			if event != nil {
+				event.summary = icalText.Replace(value)
+			}
+		case "DTSTART", "DTEND":
+			if event == nil {
+				continue
+			}
+			t, err := h.parseICalTime(params[1:], value)
+			if err != nil {
+				return err
+			}
+			if strings.EqualFold(params[0], "DTSTART") {
+				event.from = t
+			} else {
+				event.to = t
+			}
+		case "RRULE":
+			if event != nil && strings.Contains(strings.ToUpper(value), "FREQ=YEARLY") {
+				event.yearly = true
+			}
+		}
+	}
+	return nil
+}
+
+// Unescapes iCalendar text values, shown on a single line
+var icalText = strings.NewReplacer(`\\`, `\`, `\,`, ",", `\;`, ";", `\n`, " ", `\N`, " ")
+
+// Parses a date, or a date and time in UTC, in the TZID parameter's zone or
+// else in the business hours' one
+func (h *BusinessHours) parseICalTime(params []string, value string) (time.Time, error) {
+	location := h.location
+	for _, param := range params {
+		if strings.HasPrefix(strings.ToUpper(param), "TZID=") {
+			if l, err := time.LoadLocation(param[5:]); err == nil {
+				location = l
+			}
+		}
+	}
+	switch {
+	case len(value) == 8:
+		return time.ParseInLocation("20060102", value, h.location)
+	case strings.HasSuffix(value, "Z"):
+		return time.Parse("20060102T150405Z", value)
+	default:
+		return time.ParseInLocation("20060102T150405", value, location)
+	}
+}
+
+// The holiday the time falls on, nil if it's a working day
+func (h *BusinessHours) holiday(t time.Time) *holiday {
+	for i := range h.holidays {
+		day := &h.holidays[i]
+		from, to := day.from, day.to
+		if day.yearly {
+			// moved to the year of t, or the year before if it spans new year
+			years := t.Year() - from.Year()
+			from, to = from.AddDate(years, 0, 0), to.AddDate(years, 0, 0)
+			if from.After(t) {
+				from, to = from.AddDate(-1, 0, 0), to.AddDate(-1, 0, 0)
+			}
+		}
+		if !t.Before(from) && t.Before(to) {
+			return day
+		}
+	}
+	return nil
+}
+
+// Whether agents are at work at that time. Nil business hours are always
+func (h *BusinessHours) Open(t time.Time) bool {
+	if h == nil {
+		return true
+	}
+	t = t.In(h.location)
+	if h.holiday(t) != nil {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	for _, s := range h.week[t.Weekday()] {
+		if minute >= s.from && minute < s.to {
+			return true
+		}
+	}
+	return false
+}
+
+// What the widget shows outside business hours
+func (h *BusinessHours) Notice() string {
+	return strings.TrimSpace(h.Message + " " + h.ResponseTime)
+}
+
+// Marks the room of a conversation started outside business hours
+func (h *BusinessHours) marker(t time.Time) string {
+	t = t.In(h.location)
+	text := "After hours: the visitor wrote on " + t.Format("Monday 2 January 15:04 MST")
+	if day := h.holiday(t); day != nil && day.summary != "" {
+		text += ", " + day.summary
+	}
+	return text
+}
@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBusinessHours(t *testing.T) {
+	h, err := ParseBusinessHours("mon-fri 09:00-12:00,13:00-17:00; sat 10:00-13:00", "Europe/Paris", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paris, _ := time.LoadLocation("Europe/Paris")
+	for _, c := range []struct {
+		at   string
+		open bool
+	}{
+		{"2026-10-19 09:00", true}, // Monday
+		{"2026-10-19 12:30", false},
+		{"2026-10-19 16:59", true},
+		{"2026-10-19 17:00", false},
+		{"2026-10-24 10:00", true}, // Saturday
+		{"2026-10-25 10:00", false},
+	} {
+		at, _ := time.ParseInLocation("2006-01-02 15:04", c.at, paris)
+		if open := h.Open(at.UTC()); open != c.open {
+			t.Errorf("open at %s is %v", c.at, open)
+		}
+	}
+
+	if h, err := ParseBusinessHours(" ", "UTC", "", "", ""); h != nil || err != nil {
+		t.Errorf("an empty spec parsed as %+v, %v", h, err)
+	}
+	for _, spec := range []string{"mon", "funday 09:00-17:00", "mon 17:00-09:00", "mon 09:00-25:00"} {
+		if _, err := ParseBusinessHours(spec, "UTC", "", "", ""); err == nil {
+			t.Errorf("parsed %q", spec)
+		}
+	}
+	if _, err := ParseBusinessHours("mon-fri 09:00-17:00", "UTC", "testdata/missing.ics", "", ""); err == nil {
+		t.Error("a missing holidays file was ignored")
+	}
+}
+
+func TestHolidays(t *testing.T) {
+	h, err := ParseBusinessHours("mon-fri 09:00-20:00", "UTC", "testdata/holidays.ics", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		at      string
+		summary string // of the holiday, empty on working hours
+	}{
+		// VALUE=DATE, repeated yearly since 2020
+		{"2026-12-24 10:00", ""},
+		{"2026-12-25 10:00", "Christmas Day"},
+		{"2031-12-25 16:59", "Christmas Day"},
+		// no DTEND, a single day
+		{"2027-01-01 10:00", "New Year"},
+		{"2029-01-01 10:00", "New Year"},
+		{"2029-01-02 10:00", ""},
+		// a folded and escaped summary
+		{"2026-11-06 10:00", "Company off-site, the whole team is away for the annual planning days"},
+		// TZID, from noon to three in New York
+		{"2026-10-21 15:59", ""},
+		{"2026-10-21 16:00", "Afternoon off"},
+		{"2026-10-21 18:59", "Afternoon off"},
+		{"2026-10-21 19:00", ""},
+		// weekly rules are ignored, only the first occurrence is off
+		{"2026-10-19 10:30", "Weekly meeting"},
+		{"2026-10-26 10:30", ""},
+	} {
+		at, _ := time.Parse("2006-01-02 15:04", c.at)
+		if open := h.Open(at); open != (c.summary == "") {
+			t.Errorf("open at %s is %v", c.at, open)
+		}
+		if c.summary == "" {
+			continue
+		}
+		if marker := h.marker(at); !strings.HasSuffix(marker, ", "+c.summary) {
+			t.Errorf("marker at %s is %q", c.at, marker)
+		}
+	}
+}
+
+func TestHolidaysWithoutBusinessHours(t *testing.T) {
+	h, err := ParseBusinessHours("", "Europe/Paris", "testdata/holidays.ics", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h == nil {
+		t.Fatal("the holidays were ignored without business hours")
+	}
+	for _, c := range []struct {
+		at   string
+		open bool
+	}{
+		{"2026-10-24 03:00", true}, // Saturday night
+		{"2026-12-24 22:59", true},
+		{"2026-12-24 23:00", false}, // Christmas in Paris
+		{"2026-12-25 22:59", false},
+		{"2026-12-25 23:00", true},
+	} {
+		at, _ := time.Parse("2006-01-02 15:04", c.at)
+		if open := h.Open(at); open != c.open {
+			t.Errorf("open at %s UTC is %v", c.at, open)
+		}
+	}
+}
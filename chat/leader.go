@@ -0,0 +1,96 @@
+package chat
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Lease on a named role, kept in the shared database, so exactly one instance
+// holds it at a time. The holder renews it every third of its ttl, if it stops
+// doing so another instance takes over once the lease expires
+type LeaderLease struct {
+	name    string
+	holder  string
+	ttl     time.Duration
+	leading int32
+}
+
+func NewLeaderLease(name, holder string, ttl time.Duration) *LeaderLease {
+	return &LeaderLease{name: name, holder: holder, ttl: ttl}
+}
+
+// Acquires the lease, or renews it if already held. Returns whether this
+// instance holds it afterwards
+func (l *LeaderLease) Acquire() (bool, error) {
+	now := time.Now().UTC()
+	expires := now.Add(l.ttl).Format(TimeFormat)
+	// fails harmlessly when the row already exists, a new one is expired
+	DB.GetDB().Exec("INSERT INTO Leader (name, holder, expires) VALUES (?, '', '')", l.name)
+
+	res, err := DB.GetDB().Exec("UPDATE Leader SET holder = ?, expires = ? WHERE name = ? AND (holder = ? OR expires < ?)",
+		l.holder, expires, l.name, l.holder, now.Format(TimeFormat))
+	if err != nil {
+		l.setLeading(false)
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		l.setLeading(false)
+		return false, err
+	}
+	l.setLeading(rows == 1)
+	return rows == 1, nil
+}
+
+// Gives the lease up, so another instance doesn't wait for it to expire
+func (l *LeaderLease) Release() error {
+	l.setLeading(false)
+	_, err := DB.GetDB().Exec("UPDATE Leader SET holder = '', expires = '' WHERE name = ? AND holder = ?", l.name, l.holder)
+	return err
+}
+
+func (l *LeaderLease) Leading() bool {
+	return atomic.LoadInt32(&l.leading) == 1
+}
+
+func (l *LeaderLease) setLeading(leading bool) {
+	var v int32
+	if leading {
+		v = 1
+	}
+	atomic.StoreInt32(&l.leading, v)
+}
+
+// Runs fn whenever this instance holds the lease. The context given to fn is
+// cancelled as soon as the lease is lost, fn must return then. Never returns
+func (l *LeaderLease) Run(fn func(ctx context.Context)) {
+	renew := l.ttl / 3
+	for {
+		if ok, err := l.Acquire(); err != nil {
+			log.Printf("Could not acquire the %s lease: %s", l.name, err)
+		} else if ok {
+			log.Printf("Instance %s is now the %s leader", l.holder, l.name)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				fn(ctx)
+				close(done)
+			}()
+			for ctx.Err() == nil {
+				select {
+				case <-done:
+					cancel()
+				case <-time.After(renew):
+					if ok, err := l.Acquire(); err != nil || !ok {
+						log.Printf("Instance %s lost the %s lease", l.holder, l.name)
+						cancel()
+					}
+				}
+			}
+			<-done
+		}
+		time.Sleep(renew)
+	}
+}
@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func acquire(t *testing.T, l *LeaderLease) bool {
+	t.Helper()
+	ok, err := l.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != l.Leading() {
+		t.Errorf("%s acquired %v but leading %v", l.holder, ok, l.Leading())
+	}
+	return ok
+}
+
+func TestLeaderLeaseHandover(t *testing.T) {
+	newTestServer(t)
+	a := NewLeaderLease("sync", "a", time.Minute)
+	b := NewLeaderLease("sync", "b", time.Minute)
+
+	if !acquire(t, a) {
+		t.Fatal("a could not take the free lease")
+	}
+	if acquire(t, b) {
+		t.Fatal("b took the lease a holds")
+	}
+	if !acquire(t, a) {
+		t.Fatal("a could not renew its lease")
+	}
+	if err := a.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Leading() {
+		t.Error("a still leading after releasing")
+	}
+	if !acquire(t, b) {
+		t.Fatal("b could not take the released lease")
+	}
+	if acquire(t, a) {
+		t.Fatal("a took the lease back from b")
+	}
+}
+
+func TestLeaderLeaseExpiry(t *testing.T) {
+	newTestServer(t)
+	a := NewLeaderLease("sync", "a", time.Second)
+	b := NewLeaderLease("sync", "b", time.Second)
+
+	if !acquire(t, a) {
+		t.Fatal("a could not take the free lease")
+	}
+	if acquire(t, b) {
+		t.Fatal("b took the lease before it expired")
+	}
+	// a stops renewing, timestamps are to the second
+	time.Sleep(2100 * time.Millisecond)
+	if !acquire(t, b) {
+		t.Fatal("b could not take the expired lease")
+	}
+	if acquire(t, a) {
+		t.Fatal("a renewed a lease b holds")
+	}
+}
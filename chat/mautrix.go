@@ -1,6 +1,7 @@
 package chat
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"regexp"
@@ -97,9 +98,13 @@ type BotPlexer struct {
 	timeout     int
 	Ch          chan *mevent.Event
 	db          Database
+	lease       *LeaderLease // nil when running a single instance
+	presences   *Presences
 }
 
-func NewApp(timeout string, encrypted bool, db Database) *BotPlexer {
+// lease may be nil, otherwise only the instance holding it syncs with Matrix,
+// while every instance can send messages
+func NewApp(timeout string, encrypted bool, db Database, lease *LeaderLease) *BotPlexer {
 	res, _ := strconv.Atoi(timeout)
 	return &BotPlexer{
 		new(string),
@@ -113,17 +118,29 @@ func NewApp(timeout string, encrypted bool, db Database) *BotPlexer {
 		res,
 		make(chan *mevent.Event, 8),
 		db,
+		lease,
+		NewPresences(),
 	}
 }
 
-func (b *BotPlexer) Sync(encrypted bool) (*mautrix.DefaultSyncer, error) {
-	if encrypted {
-		return b.CryptoSync()
-	}
+// Whether this instance receives the Matrix events, and should do the work
+// that must only be done once across instances
+func (b *BotPlexer) IsLeader() bool {
+	return b.lease == nil || b.lease.Leading()
+}
 
+// Registers the handlers of the events the bot relays, and of encrypted ones
+// if encrypted
+func (b *BotPlexer) Sync(encrypted bool) (*mautrix.DefaultSyncer, error) {
 	syncer := b.client.Syncer.(*mautrix.DefaultSyncer)
 	syncer.OnEventType(mevent.EventMessage, func(source mautrix.EventSource, event *mevent.Event) { go b.HandleMessage(source, event) })
+	syncer.OnEventType(mevent.EventRedaction, func(source mautrix.EventSource, event *mevent.Event) { go b.HandleMessage(source, event) })
+	syncer.OnEventType(mevent.EventReaction, func(source mautrix.EventSource, event *mevent.Event) { go b.HandleMessage(source, event) })
+	syncer.OnEventType(mevent.EphemeralEventPresence, func(source mautrix.EventSource, event *mevent.Event) { b.handlePresence(event) })
 
+	if encrypted {
+		return b.CryptoSync()
+	}
 	return syncer, nil
 }
 
@@ -179,15 +196,13 @@ func (b *BotPlexer) CryptoSync() (*mautrix.DefaultSyncer, error) {
 		b.stateStore.SetEncryptionEvent(event)
 	})
 
-	syncer.OnEventType(mevent.EventMessage, func(source mautrix.EventSource, event *mevent.Event) { go b.HandleMessage(source, event) })
-
 	syncer.OnEventType(mevent.EventEncrypted, func(source mautrix.EventSource, event *mevent.Event) {
 		decryptedEvent, err := b.olmMachine.DecryptMegolmEvent(event)
 		if err != nil {
 			log.Errorf("Failed to decrypt message from %s in %s: %+v", event.Sender, event.RoomID, err)
 		} else {
 			log.Debugf("Received encrypted event from %s in %s", event.Sender, event.RoomID)
-			if decryptedEvent.Type == mevent.EventMessage {
+			if decryptedEvent.Type == mevent.EventMessage || decryptedEvent.Type == mevent.EventReaction {
 				go b.HandleMessage(source, decryptedEvent)
 			}
 		}
@@ -233,32 +248,51 @@ func (b *BotPlexer) Connect(recipient, srvr, uname, passwd string, encrypted boo
 		log.Fatalf("Couldn't login to the homeserver.")
 	}
 
-	//syncer, err := b.Sync(encrypted)
-	syncer := b.client.Syncer.(*mautrix.DefaultSyncer)
-	syncer.OnEventType(mevent.EventMessage, func(source mautrix.EventSource, event *mevent.Event) { go b.HandleMessage(source, event) })
-
+	syncer, err := b.Sync(encrypted)
 	if err != nil || syncer == nil {
-		log.Errorf("Error occurred: %v", err.Error())
+		log.Errorf("Error occurred: %v", err)
 	}
 
 	log.Infof("Logged in as %s/%s", b.client.UserID, b.client.DeviceID)
 
-	for {
+	if b.lease == nil {
+		b.syncLoop(context.Background())
+		return
+	}
+	b.lease.Run(b.syncLoop)
+}
+
+// Syncs with the homeserver until ctx is cancelled
+func (b *BotPlexer) syncLoop(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		b.client.StopSync()
+	}()
+	for ctx.Err() == nil {
 		log.Debugf("Running sync...")
-		err = b.client.Sync()
-		if err != nil {
+		err := b.client.SyncWithContext(ctx)
+		if err != nil && ctx.Err() == nil {
 			log.Errorf("Sync failed. %+v", err)
 		}
 	}
 }
 
+// The agent conversations are offered to when there's no pool of agents
+func (b *BotPlexer) Recipient() mid.UserID {
+	return mid.UserID(*b.recipient)
+}
+
 func (b *BotPlexer) GetMessages(roomid mid.RoomID, offset int) []*JSONMessage {
 	//TODO
 	return nil
 }
 
-// There's no goroutine running this function... you have to spawn it somewhere
-func (b *BotPlexer) CreateRoom(client *Client, encrypted bool) (resp mid.RoomID, err error) {
+// There's no goroutine running this function... you have to spawn it somewhere.
+// The agent is invited, MATRIX_RECIPIENT if it's empty
+func (b *BotPlexer) CreateRoom(session *Session, encrypted bool, agent mid.UserID) (resp mid.RoomID, err error) {
+	if agent == "" {
+		agent = mid.UserID(*b.recipient)
+	}
 	var preset string
 	if encrypted {
 		preset = "private_chat"
@@ -267,9 +301,9 @@ func (b *BotPlexer) CreateRoom(client *Client, encrypted bool) (resp mid.RoomID,
 	}
 	response, err := b.client.CreateRoom(&mautrix.ReqCreateRoom{
 		Preset:        preset,
-		RoomAliasName: (*client.session.Alias) + "_" + (*client.session.SessionId)[:6],
+		RoomAliasName: (*session.Alias) + "_" + (*session.SessionId)[:6],
 		Topic:         "livechat",
-		Invite:        []id.UserID{id.UserID(*b.recipient)},
+		Invite:        []id.UserID{agent},
 	})
 
 	if err != nil {
@@ -292,11 +326,17 @@ func (b *BotPlexer) HandleMessage(source mautrix.EventSource, event *mevent.Even
 	}
 }
 
-func (b *BotPlexer) SendMessage(roomId mid.RoomID, content *mevent.MessageEventContent) (resp *mautrix.RespSendEvent, err error) {
+// Sends a message to the room. Sending again with the same non-empty txnID
+// doesn't duplicate it, the homeserver answers with the event already sent
+func (b *BotPlexer) SendMessage(roomId mid.RoomID, content *mevent.MessageEventContent, txnID string) (resp *mautrix.RespSendEvent, err error) {
 	eventContent := &mevent.Content{Parsed: content}
+	if txnID == "" {
+		// retries must reuse the transaction ID too
+		txnID = b.client.TxnID()
+	}
 	r, err := DoRetry(fmt.Sprintf("send message to %s", roomId), func() (interface{}, error) {
 		//Sending unencrypted event
-		return b.client.SendMessageEvent(roomId, mevent.EventMessage, eventContent)
+		return b.client.SendMessageEvent(roomId, mevent.EventMessage, eventContent, mautrix.ReqSendEvent{TransactionID: txnID})
 	})
 	if err != nil {
 		log.Errorf("Failed to send message to %s: %s", roomId, err)
@@ -305,6 +345,125 @@ func (b *BotPlexer) SendMessage(roomId mid.RoomID, content *mevent.MessageEventC
 	return r.(*mautrix.RespSendEvent), err
 }
 
+// Posts a notice, shown by Matrix clients as written by a bot
+func (b *BotPlexer) SendNotice(roomId mid.RoomID, text string) error {
+	_, err := DoRetry(fmt.Sprintf("send notice to %s", roomId), func() (interface{}, error) {
+		return b.client.SendNotice(roomId, text)
+	})
+	if err != nil {
+		log.Errorf("Failed to send notice to %s: %s", roomId, err)
+	}
+	return err
+}
+
+func (b *BotPlexer) InviteUser(roomId mid.RoomID, user mid.UserID) error {
+	_, err := DoRetry(fmt.Sprintf("invite %s to %s", user, roomId), func() (interface{}, error) {
+		return b.client.InviteUser(roomId, &mautrix.ReqInviteUser{UserID: user})
+	})
+	if err != nil {
+		log.Errorf("Failed to invite %s to %s: %s", user, roomId, err)
+	}
+	return err
+}
+
+// Whether the user joined the room, rather than only being invited
+func (b *BotPlexer) HasJoined(roomId mid.RoomID, user mid.UserID) (bool, error) {
+	r, err := DoRetry(fmt.Sprintf("list members of %s", roomId), func() (interface{}, error) {
+		return b.client.JoinedMembers(roomId)
+	})
+	if err != nil {
+		return false, err
+	}
+	_, joined := r.(*mautrix.RespJoinedMembers).Joined[user]
+	return joined, nil
+}
+
+// Removes the user from the room
+func (b *BotPlexer) KickUser(roomId mid.RoomID, user mid.UserID, reason string) error {
+	_, err := DoRetry(fmt.Sprintf("kick %s from %s", user, roomId), func() (interface{}, error) {
+		return b.client.KickUser(roomId, &mautrix.ReqKickUser{UserID: user, Reason: reason})
+	})
+	if err != nil {
+		log.Errorf("Failed to kick %s from %s: %s", user, roomId, err)
+	}
+	return err
+}
+
+// The user's display name, or the localpart of their ID if they have none
+func (b *BotPlexer) DisplayName(user mid.UserID) string {
+	if resp, err := b.client.GetDisplayName(user); err == nil && resp.DisplayName != "" {
+		return resp.DisplayName
+	}
+	localpart, _, err := user.Parse()
+	if err != nil {
+		return user.String()
+	}
+	return localpart
+}
+
+// The user's avatar, empty if they have none
+func (b *BotPlexer) AvatarURL(user mid.UserID) (mid.ContentURI, error) {
+	return b.client.GetAvatarURL(user)
+}
+
+// Downloads a file of the homeserver's media repository
+func (b *BotPlexer) Download(uri mid.ContentURI) ([]byte, error) {
+	return b.client.DownloadBytes(uri)
+}
+
+func (b *BotPlexer) LeaveRoom(roomId mid.RoomID) error {
+	_, err := DoRetry(fmt.Sprintf("leave %s", roomId), func() (interface{}, error) {
+		return b.client.LeaveRoom(roomId)
+	})
+	if err != nil {
+		log.Errorf("Failed to leave %s: %s", roomId, err)
+	}
+	return err
+}
+
+// Renames a room whose conversation is over, explains why in its topic, and
+// leaves it
+func (b *BotPlexer) ArchiveRoom(roomId mid.RoomID, name, topic string) error {
+	_, err := DoRetry(fmt.Sprintf("rename %s", roomId), func() (interface{}, error) {
+		return b.client.SendStateEvent(roomId, mevent.StateRoomName, "", &mevent.RoomNameEventContent{Name: name})
+	})
+	if err != nil {
+		log.Errorf("Failed to rename %s: %s", roomId, err)
+	}
+	_, err = DoRetry(fmt.Sprintf("set topic of %s", roomId), func() (interface{}, error) {
+		return b.client.SendStateEvent(roomId, mevent.StateTopic, "", &mevent.TopicEventContent{Topic: topic})
+	})
+	if err != nil {
+		log.Errorf("Failed to set topic of %s: %s", roomId, err)
+	}
+	return b.LeaveRoom(roomId)
+}
+
+// Reacts to the event with the key, usually an emoji
+func (b *BotPlexer) SendReaction(roomId mid.RoomID, eventId mid.EventID, key string) (mid.EventID, error) {
+	r, err := DoRetry(fmt.Sprintf("react to %s in %s", eventId, roomId), func() (interface{}, error) {
+		return b.client.SendReaction(roomId, eventId, key)
+	})
+	if err != nil {
+		log.Errorf("Failed to react to %s in %s: %s", eventId, roomId, err)
+		return "", err
+	}
+	return r.(*mautrix.RespSendEvent).EventID, nil
+}
+
+func (b *BotPlexer) RedactEvent(roomId mid.RoomID, eventId mid.EventID, reason string) error {
+	if b.client == nil {
+		return errors.New("not connected to the homeserver")
+	}
+	_, err := DoRetry(fmt.Sprintf("redact %s in %s", eventId, roomId), func() (interface{}, error) {
+		return b.client.RedactEvent(roomId, eventId, mautrix.ReqRedact{Reason: reason})
+	})
+	if err != nil {
+		log.Errorf("Failed to redact %s in %s: %s", eventId, roomId, err)
+	}
+	return err
+}
+
 func DoRetry(description string, fn func() (interface{}, error)) (interface{}, error) {
 	var err error
 	b := retry.NewFibonacci(1 * time.Second)
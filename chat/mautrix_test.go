@@ -0,0 +1,58 @@
+package chat
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+	mevent "maunium.net/go/mautrix/event"
+)
+
+func TestSyncRegistersHandlers(t *testing.T) {
+	s := newTestServer(t)
+	newFakeHomeserver(t, s)
+	b := s.Mautrix_client
+	*b.username = "@bot:example.org"
+	syncer, err := b.Sync(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp mautrix.RespSync
+	err = json.Unmarshal([]byte(`{
+		"next_batch": "s1",
+		"rooms": {"join": {"!room:example.org": {"timeline": {"events": [
+			{"type": "m.room.message", "event_id": "$message", "sender": "@agent:example.org", "origin_server_ts": 1, "content": {"msgtype": "m.text", "body": "hello"}},
+			{"type": "m.reaction", "event_id": "$reaction", "sender": "@agent:example.org", "origin_server_ts": 2, "content": {"m.relates_to": {"rel_type": "m.annotation", "event_id": "$message", "key": "👍"}}},
+			{"type": "m.room.redaction", "event_id": "$redaction", "sender": "@agent:example.org", "origin_server_ts": 3, "redacts": "$message", "content": {}}
+		]}}}},
+		"presence": {"events": [
+			{"type": "m.presence", "sender": "@agent:example.org", "content": {"presence": "unavailable"}}
+		]}
+	}`), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syncer.ProcessResponse(&resp, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[mevent.Type]bool{}
+	for len(seen) < 3 {
+		select {
+		case evt := <-b.Ch:
+			seen[evt.Type] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %v relayed", seen)
+		}
+	}
+	for _, typ := range []mevent.Type{mevent.EventMessage, mevent.EventReaction, mevent.EventRedaction} {
+		if !seen[typ] {
+			t.Errorf("%s not relayed", typ.Type)
+		}
+	}
+	if state, ok := b.presences.get("@agent:example.org"); !ok || state != mevent.PresenceUnavailable {
+		t.Errorf("presence %q, %v", state, ok)
+	}
+}
@@ -1,10 +1,66 @@
 package chat
 
-import "fmt"
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"time"
 
+	mid "maunium.net/go/mautrix/id"
+)
+
+// Timestamps are stored as UTC strings in this format, so that they can be
+// compared lexicographically by the database as well
+const TimeFormat = "2006-01-02 15:04:05"
+
+// Frames exchanged with the widget. Chat messages leave Type empty, control
+// frames such as heartbeats set it and may carry no author nor body. Stored
+// messages carry their sequence number within the session, and the ID the
+// widget gave them if it's the visitor's
 type JSONMessage struct {
-	Author string `json:"author"`
-	Body   string `json:"body"`
+	Type    string `json:"type,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Seq     int    `json:"seq,omitempty"`
+	Ref     int    `json:"ref,omitempty"` // seq of the message replied to, or the one a frame is about
+	EventID string `json:"event_id,omitempty"`
+	Author  string `json:"author"`
+	Body    string `json:"body"`
+	HTML    string `json:"html,omitempty"` // sanitized rendering of Body, for agents' messages
+
+	Name   string `json:"name,omitempty"`   // of the agent who wrote the message
+	Avatar string `json:"avatar,omitempty"` // path of the agent's avatar on the server
+	Auto   bool   `json:"auto,omitempty"`   // the bot answered on its own
+
+	Position int `json:"position,omitempty"` // in the queue
+	Wait     int `json:"wait,omitempty"`     // estimated, in seconds
+}
+
+const (
+	FramePing    = "ping"
+	FramePong    = "pong"
+	FrameHello   = "hello"   // first frame of transports the visitor can't write to, Body is the client ID
+	FrameAck     = "ack"     // the widget has every message up to Seq, or the server stored the visitor's message ID as Seq
+	FrameEdit    = "edit"    // the message Ref now reads Body
+	FrameDelete  = "delete"  // the message Ref was deleted
+	FrameReact   = "react"   // Author reacted to the message Ref with Body
+	FrameUnreact = "unreact" // Author took their Body reaction to the message Ref back
+	FrameError   = "error"   // the visitor's frame ID was rejected, Body says why
+	FrameClose   = "close"   // the visitor closes the conversation
+	FrameClosed  = "closed"  // the conversation was closed, Body says by whom
+	FrameStatus  = "status"  // Body tells whether agents are online, see StatusOnline
+	FrameContact = "contact" // the visitor leaves Body as their email address
+
+	FrameAfterHours = "after_hours" // the visitor came outside business hours, Body says when agents answer
+	FrameQueue      = "queue"       // the visitor waits at Position for about Wait seconds, or no longer without them
+	FrameSystem     = "system"      // something happened in the conversation, Body says what, see SystemTransfer
+)
+
+// IDs the widget may give its messages, so that resending one after a lost
+// connection doesn't duplicate it
+var clientIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func ValidClientID(id string) bool {
+	return clientIDPattern.MatchString(id)
 }
 
 func (self *JSONMessage) String() string {
@@ -12,24 +68,193 @@ func (self *JSONMessage) String() string {
 }
 
 func NewJSONMessage(message, author string) *JSONMessage {
-	return &JSONMessage{author, message}
+	return &JSONMessage{Author: author, Body: message}
 }
 
 type Message struct {
-	Author *string `db:"author"`
-	Body   *string `db:"body"`
+	Id       int     `db:"id"`
+	Seq      int     `db:"seq"`
+	Session  *string `db:"session"`
+	Author   *string `db:"author"`
+	Body     *string `db:"body"`
+	HTML     *string `db:"html"`
+	EventID  *string `db:"event_id"`
+	Room     *string `db:"room"` // the event_id is in
+	ClientID *string `db:"client_id"`
+	ReplyTo  int     `db:"reply_to"` // seq of the message replied to
+	Name     *string `db:"name"`     // shown for the agent who wrote it
+	Avatar   *string `db:"avatar"`   // path of the agent's avatar on this server
+	Auto     bool    `db:"auto"`     // sent by the bot on its own, not by an agent
+	Sender   *string `db:"sender"`   // Matrix user who wrote it, empty if the bot sent it
+	Created  *string `db:"created"`
 }
 
 func NewMessage(author, body *string) *Message {
+	created := time.Now().UTC().Format(TimeFormat)
 	if len(*author) == 0 || len(*body) == 0 {
 		return &Message{
+			0,
+			0,
+			new(string),
+			new(string),
+			new(string),
+			new(string),
+			new(string),
+			new(string),
+			new(string),
+			0,
 			new(string),
 			new(string),
+			false,
+			new(string),
+			&created,
 		}
 	} else {
 		return &Message{
+			0,
+			0,
+			new(string),
 			author,
 			body,
+			new(string),
+			new(string),
+			new(string),
+			new(string),
+			0,
+			new(string),
+			new(string),
+			false,
+			new(string),
+			&created,
+		}
+	}
+}
+
+// Times Create tries to number a message when concurrent inserts for the same
+// session keep taking its number
+const createAttempts = 5
+
+// Stores the message on the database, it must already belong to a session.
+// It's numbered after the last message of that session. It fails if the
+// session already has a message with the same client ID
+func (m *Message) Create() error {
+	var clientID interface{}
+	if *m.ClientID != "" {
+		clientID = *m.ClientID
+	}
+	var res sql.Result
+	var err error
+	for attempt := 1; ; attempt++ {
+		res, err = DB.GetDB().Exec(`INSERT INTO Message (session, author, body, html, event_id, room, client_id, reply_to, name, avatar, auto, sender, created, seq)
+			SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, COALESCE(MAX(seq), 0) + 1 FROM Message WHERE session = ?`,
+			*m.Session, *m.Author, *m.Body, *m.HTML, *m.EventID, *m.Room, clientID, m.ReplyTo, *m.Name, *m.Avatar, m.Auto, *m.Sender, *m.Created, *m.Session)
+		if err == nil || attempt == createAttempts || !isConflict(err) {
+			break
 		}
+		// a duplicate client ID stays one
+		if clientID != nil {
+			if prev, _ := FindMessage(*m.Session, *m.ClientID); prev != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	m.Id = int(id)
+	return DB.GetDB().QueryRow("SELECT seq FROM Message WHERE id = ?", m.Id).Scan(&m.Seq)
+}
+
+// Records the Matrix event the message was relayed as, and its room
+func (m *Message) SetEventID(room mid.RoomID, eventID mid.EventID) error {
+	*m.EventID = eventID.String()
+	*m.Room = room.String()
+	_, err := DB.GetDB().Exec("UPDATE Message SET event_id = ?, room = ? WHERE id = ?", *m.EventID, *m.Room, m.Id)
+	return err
+}
+
+// Replaces the message's body and its HTML, an empty body deletes it
+func (m *Message) SetBody(body, html string) error {
+	*m.Body = body
+	*m.HTML = html
+	_, err := DB.GetDB().Exec("UPDATE Message SET body = ?, html = ? WHERE id = ?", body, html, m.Id)
+	return err
+}
+
+// Matrix transaction ID to relay the message with, the homeserver ignores
+// the message if it's relayed again. Empty if the widget didn't give it an ID
+func (m *Message) TxnID() string {
+	if *m.ClientID == "" {
+		return ""
+	}
+	return fmt.Sprintf("livematrix.%d.%s", m.Id, *m.ClientID)
+}
+
+// The frame delivering the message to the widget
+func (m *Message) Frame() *JSONMessage {
+	return &JSONMessage{ID: *m.ClientID, Seq: m.Seq, Ref: m.ReplyTo, Author: *m.Author, Body: *m.Body, HTML: *m.HTML, Name: *m.Name, Avatar: *m.Avatar, Auto: m.Auto}
+}
+
+// Loads every message of a session still holding a body, oldest first, so the
+// history survives restarts and sockets being removed from the server
+func LoadMessages(sessid string) ([]*Message, error) {
+	rows, err := DB.GetDB().Query("SELECT id, seq, author, body, COALESCE(html, ''), event_id, COALESCE(room, ''), COALESCE(client_id, ''), COALESCE(reply_to, 0), COALESCE(name, ''), COALESCE(avatar, ''), COALESCE(auto, 0), COALESCE(sender, ''), created FROM Message WHERE session = ? AND body != '' ORDER BY seq", sessid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*Message{}
+	for rows.Next() {
+		msg := NewMessage(new(string), new(string))
+		*msg.Session = sessid
+		if err := rows.Scan(&msg.Id, &msg.Seq, msg.Author, msg.Body, msg.HTML, msg.EventID, msg.Room, msg.ClientID, &msg.ReplyTo, msg.Name, msg.Avatar, &msg.Auto, msg.Sender, msg.Created); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// Finds the message of the session the widget gave the ID to, nil if there's
+// none
+func FindMessage(sessid, clientID string) (*Message, error) {
+	return findMessage("session = ? AND client_id = ?", sessid, clientID)
+}
+
+// Finds the message of the session numbered seq, nil if there's none
+func MessageBySeq(sessid string, seq int) (*Message, error) {
+	return findMessage("session = ? AND seq = ?", sessid, seq)
+}
+
+// Finds the message relayed as, or from, a Matrix event, nil if there's none
+func MessageByEvent(eventID mid.EventID) (*Message, error) {
+	return findMessage("event_id = ?", eventID.String())
+}
+
+func findMessage(where string, args ...interface{}) (*Message, error) {
+	msg := NewMessage(new(string), new(string))
+	row := DB.GetDB().QueryRow("SELECT id, seq, session, author, body, COALESCE(html, ''), event_id, COALESCE(room, ''), COALESCE(client_id, ''), COALESCE(reply_to, 0), COALESCE(name, ''), COALESCE(avatar, ''), COALESCE(auto, 0), COALESCE(sender, ''), created FROM Message WHERE "+where, args...)
+	err := row.Scan(&msg.Id, &msg.Seq, msg.Session, msg.Author, msg.Body, msg.HTML, msg.EventID, msg.Room, msg.ClientID, &msg.ReplyTo, msg.Name, msg.Avatar, &msg.Auto, msg.Sender, msg.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Whether a Matrix event was already stored as a message
+func MessageExists(eventID mid.EventID) (bool, error) {
+	var count int
+	row := DB.GetDB().QueryRow("SELECT COUNT(*) FROM Message WHERE event_id = ?", eventID.String())
+	if err := row.Scan(&count); err != nil {
+		return false, err
 	}
+	return count > 0, nil
 }
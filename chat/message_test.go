@@ -0,0 +1,89 @@
+package chat
+
+import (
+	"sort"
+	"sync"
+	"testing"
+)
+
+func newTestMessage(sessid, clientID string) *Message {
+	author, body := "Ada_Lovelace", "hello"
+	msg := NewMessage(&author, &body)
+	*msg.Session = sessid
+	*msg.ClientID = clientID
+	return msg
+}
+
+func TestMessageCreateNumbersConcurrently(t *testing.T) {
+	newTestServer(t)
+	newTestSession(t, "visitor", "")
+
+	const n = 20
+	seqs := make([]int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := newTestMessage("visitor", "")
+			if err := msg.Create(); err != nil {
+				t.Error(err)
+				return
+			}
+			seqs[i] = msg.Seq
+		}(i)
+	}
+	wg.Wait()
+
+	sort.Ints(seqs)
+	for i, seq := range seqs {
+		if seq != i+1 {
+			t.Fatalf("sequence numbers %v, want 1 to %d", seqs, n)
+		}
+	}
+}
+
+func TestMessageSeqUnique(t *testing.T) {
+	newTestServer(t)
+	newTestSession(t, "visitor", "")
+	if err := newTestMessage("visitor", "").Create(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := DB.GetDB().Exec("INSERT INTO Message (session, author, body, seq) VALUES ('visitor', 'Ada_Lovelace', 'again', 1)")
+	if !isConflict(err) {
+		t.Errorf("stored a second message numbered 1: %v", err)
+	}
+}
+
+func TestMessageCreateDuplicateClientID(t *testing.T) {
+	newTestServer(t)
+	newTestSession(t, "visitor", "")
+	if err := newTestMessage("visitor", "client-1").Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestMessage("visitor", "client-1").Create(); !isConflict(err) {
+		t.Errorf("stored a second message with the same client ID: %v", err)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM Message WHERE session = 'visitor'"); n != 1 {
+		t.Errorf("%d messages stored, want 1", n)
+	}
+}
+
+func TestCreateTablesKeepsSeq(t *testing.T) {
+	newTestServer(t)
+	newTestSession(t, "visitor", "")
+	msg := newTestMessage("visitor", "")
+	if err := msg.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.GetDB().Exec("UPDATE Message SET seq = 7 WHERE id = ?", msg.Id); err != nil {
+		t.Fatal(err)
+	}
+	// restarting doesn't renumber messages
+	if err := NewStateStore(DB.GetDB()).CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, "SELECT seq FROM Message WHERE id = ?", msg.Id); n != 7 {
+		t.Errorf("message renumbered %d", n)
+	}
+}
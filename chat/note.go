@@ -0,0 +1,92 @@
+package chat
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	mevent "maunium.net/go/mautrix/event"
+)
+
+// Note an agent kept about a session's conversation, never shown to the
+// visitor. Written with !note, or in the room as a notice or with the
+// internal prefix
+type Note struct {
+	Id           int
+	Session      string
+	Conversation int    // id of the conversation it's attached to, zero if none
+	Author       string // Matrix ID of the agent
+	Body         string
+	EventID      string // of the agent's message, empty for !note
+	Created      string
+}
+
+func (n *Note) Create() error {
+	if n.Created == "" {
+		n.Created = time.Now().UTC().Format(TimeFormat)
+	}
+	if n.Conversation == 0 {
+		if conv, err := CurrentConversation(n.Session); err == nil && conv != nil {
+			n.Conversation = conv.Id
+		}
+	}
+	res, err := DB.GetDB().Exec("INSERT INTO Note (session, conversation, author, body, event_id, created) VALUES (?, ?, ?, ?, ?, ?)",
+		n.Session, n.Conversation, n.Author, n.Body, n.EventID, n.Created)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	n.Id = int(id)
+	return err
+}
+
+// Every note of the session still holding a body, oldest first
+func LoadNotes(sessid string) ([]*Note, error) {
+	rows, err := DB.GetDB().Query("SELECT id, COALESCE(conversation, 0), author, body, COALESCE(event_id, ''), created FROM Note WHERE session = ? AND body != '' ORDER BY id", sessid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	notes := []*Note{}
+	for rows.Next() {
+		n := &Note{Session: sessid}
+		if err := rows.Scan(&n.Id, &n.Conversation, &n.Author, &n.Body, &n.EventID, &n.Created); err != nil {
+			return nil, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+// Whether a Matrix event was already stored as a note
+func NoteExists(eventID string) (bool, error) {
+	var count int
+	row := DB.GetDB().QueryRow("SELECT COUNT(*) FROM Note WHERE event_id = ?", eventID)
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Whether an agent's message is meant for the other agents only: a notice, or
+// written with the internal prefix
+func (s *Server) internal(content *mevent.MessageEventContent, body string) bool {
+	return content.MsgType == mevent.MsgNotice || (s.notePrefix != "" && strings.HasPrefix(body, s.notePrefix))
+}
+
+// Keeps an agent's internal message as a note of the session's conversation,
+// instead of relaying it to the visitor
+func (s *Server) routeNote(sessid string, evt *mevent.Event, body string) {
+	if seen, err := NoteExists(evt.ID.String()); err != nil || seen {
+		return
+	}
+	note := &Note{
+		Session: sessid,
+		Author:  evt.Sender.String(),
+		Body:    strings.TrimSpace(strings.TrimPrefix(body, s.notePrefix)),
+		EventID: evt.ID.String(),
+	}
+	if err := note.Create(); err != nil {
+		log.Println("Could not store note:", err)
+	}
+}
@@ -0,0 +1,94 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// An agent's reply to the visitor's message $question, quoting it in the
+// fallback as Matrix clients do
+func replyEvent(t *testing.T, eventID, body string) *mevent.Event {
+	t.Helper()
+	evt := &mevent.Event{ID: mid.EventID(eventID), Type: mevent.EventMessage, RoomID: "!room:example.org", Sender: "@agent:example.org"}
+	raw, _ := json.Marshal(map[string]interface{}{
+		"msgtype":        "m.text",
+		"body":           "> <@livechat:example.org> Where is my order?\n\n" + body,
+		"m.relates_to":   map[string]interface{}{"m.in_reply_to": map[string]string{"event_id": "$question"}},
+		"format":         "org.matrix.custom.html",
+		"formatted_body": "<mx-reply><blockquote>Where is my order?</blockquote></mx-reply>" + body,
+	})
+	if err := json.Unmarshal(raw, &evt.Content); err != nil {
+		t.Fatal(err)
+	}
+	if err := evt.Content.ParseRaw(evt.Type); err != nil {
+		t.Fatal(err)
+	}
+	return evt
+}
+
+func TestRouteReplies(t *testing.T) {
+	s := newTestServer(t)
+	hs := newFakeHomeserver(t, s)
+	session := newTestSession(t, "visitor", "!room:example.org")
+	transport := newFakeTransport()
+	c := NewClient(transport, context.Background(), s, session)
+	s.registry.Add(c)
+	done := make(chan struct{})
+	go func() {
+		c.Listen()
+		close(done)
+	}()
+	defer func() {
+		c.Close()
+		waitFor(t, done, "the client to stop")
+	}()
+	question := newTestMessage("visitor", "q1")
+	if err := question.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err := question.SetEventID("!room:example.org", "$question"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.route(replyEvent(t, "$note", "// they were refunded last week"))
+	s.route(replyEvent(t, "$command", "!note check the refund"))
+	s.route(replyEvent(t, "$answer", "It ships tomorrow"))
+
+	notes, err := LoadNotes("visitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 || notes[0].Body != "they were refunded last week" || notes[0].EventID != "$note" || notes[1].Body != "check the refund" {
+		t.Errorf("notes %+v, want the note and the !note replies", notes)
+	}
+	if n := len(hs.sent("Note kept")); n != 1 {
+		t.Errorf("%d replies to the !note command", n)
+	}
+	answer, err := MessageByEvent("$answer")
+	if err != nil || answer == nil || *answer.Body != "It ships tomorrow" || answer.ReplyTo != question.Seq {
+		t.Fatalf("answer %+v stored, %v", answer, err)
+	}
+	eventually(t, func() bool {
+		transport.mutex.Lock()
+		defer transport.mutex.Unlock()
+		for _, msg := range transport.sent {
+			if msg.Seq == answer.Seq {
+				return true
+			}
+		}
+		return false
+	}, "the answer")
+	time.Sleep(50 * time.Millisecond)
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	for _, msg := range transport.sent {
+		if msg.Author == "0" && msg.Seq != answer.Seq {
+			t.Errorf("the visitor was sent %+v", msg)
+		}
+	}
+}
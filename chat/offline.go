@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// Bodies of status frames
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// Longest email address a visitor may leave
+const maxEmailLength = 100
+
+// Room agents follow up from, where visitors' messages go while no agent is
+// online, instead of a room of their own
+type OfflineInbox struct {
+	Room   mid.RoomID // empty disables the offline mode
+	mutex  sync.Mutex
+	joined bool
+}
+
+func NewOfflineInbox(room string) *OfflineInbox {
+	return &OfflineInbox{Room: mid.RoomID(room)}
+}
+
+// Whether sessions without a room should write to the offline inbox
+func (s *Server) offlineMode() bool {
+	return s.inbox.Room != "" && !s.AgentsOnline()
+}
+
+// Joins the offline inbox the first time it's posted to, the bot only needs to
+// be invited
+func (s *Server) joinInbox() {
+	s.inbox.mutex.Lock()
+	defer s.inbox.mutex.Unlock()
+	if s.inbox.joined {
+		return
+	}
+	if _, err := s.Mautrix_client.JoinRoomByID(s.inbox.Room); err != nil {
+		log.Printf("Could not join the offline inbox %s: %s", s.inbox.Room, err)
+		return
+	}
+	s.inbox.joined = true
+}
+
+// Posts a visitor's message to the offline inbox, with who they are and how to
+// reach them
+func (s *Server) sendOffline(sessid string, message *Message) {
+	session := NewSession(nil, nil)
+	if err := DB.GetByPk(session, sessid, "session"); err != nil {
+		log.Println("Could not load session:", err)
+		return
+	}
+	email := *session.Email
+	if email == "" {
+		email = "no email address yet"
+	}
+	content := mevent.MessageEventContent{
+		MsgType: mevent.MsgNotice,
+		Body: fmt.Sprintf("Offline message from %s <%s>, session %s: %s",
+			strings.Replace(*session.Alias, "_", " ", 1), email, sessid, *message.Body),
+	}
+	s.joinInbox()
+	resp, err := s.Mautrix_client.SendMessage(s.inbox.Room, &content, message.TxnID())
+	if err != nil {
+		return
+	}
+	if err := message.SetEventID(s.inbox.Room, resp.EventID); err != nil {
+		log.Println("Could not store message event:", err)
+	}
+}
+
+// Handles the contact frame of a visitor leaving their email address, for
+// agents to follow up on messages left while they were offline
+func (s *Server) receiveContact(c *Client, msg JSONMessage) *JSONMessage {
+	email := strings.TrimSpace(msg.Body)
+	if len(email) > maxEmailLength || strings.ContainsAny(email, " <>") || !strings.Contains(email, "@") {
+		return &JSONMessage{Type: FrameError, ID: msg.ID, Body: ErrorInvalidEmail}
+	}
+	sessid := *c.session.SessionId
+	if _, err := DB.GetDB().Exec("UPDATE Session SET email = ? WHERE session = ?", email, sessid); err != nil {
+		log.Println("Could not store email:", err)
+		return nil
+	}
+	if s.inbox.Room != "" {
+		if room, err := RoomBySession(sessid); err == nil && room == "" {
+			text := fmt.Sprintf("Session %s left %s as their email address", sessid, email)
+			s.joinInbox()
+			s.Mautrix_client.SendNotice(s.inbox.Room, text)
+		}
+	}
+	return &JSONMessage{Type: FrameAck, ID: msg.ID}
+}
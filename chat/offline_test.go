@@ -0,0 +1,76 @@
+package chat
+
+import (
+	"testing"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+const agent = mid.UserID("@agent:example.org")
+
+// Server whose agent is offline, with an offline inbox
+func newOfflineServer(t *testing.T) (*Server, *fakeHomeserver) {
+	t.Helper()
+	s := newTestServer(t)
+	hs := newFakeHomeserver(t, s)
+	s.inbox = NewOfflineInbox("!inbox:example.org")
+	*s.Mautrix_client.recipient = agent.String()
+	setPresence(s.Mautrix_client, mevent.PresenceOffline, agent)
+	return s, hs
+}
+
+func TestOfflineMessagesGoToInbox(t *testing.T) {
+	s, hs := newOfflineServer(t)
+	c, done := listenTestClient(t, s, newFakeTransport(), "visitor")
+	defer func() {
+		c.Close()
+		waitFor(t, done, "the client to stop")
+	}()
+
+	s.Receive(c, JSONMessage{ID: "m1", Body: "Anyone there?"})
+	s.Receive(c, JSONMessage{ID: "m2", Body: "Call me back"})
+	if n := len(hs.sent("/rooms/!inbox:example.org/send/")); n != 2 {
+		t.Fatalf("%d messages sent to the inbox, want 2", n)
+	}
+	if n := len(hs.sent("no email address yet\\u003e, session visitor: Call me back")); n != 1 {
+		t.Errorf("%d offline messages saying who wrote them", n)
+	}
+	if n := len(hs.sent("/join")); n != 1 {
+		t.Errorf("joined the inbox %d times, want once", n)
+	}
+	if n := len(hs.sent("/createRoom")); n != 0 {
+		t.Errorf("created %d rooms while agents were offline", n)
+	}
+	message, err := FindMessage("visitor", "m1")
+	if err != nil || message == nil || *message.Room != "!inbox:example.org" {
+		t.Errorf("message %+v stored without its inbox event, %v", message, err)
+	}
+
+	ack := s.Receive(c, JSONMessage{Type: FrameContact, ID: "m3", Body: " ada@example.org "})
+	if ack == nil || ack.Type != FrameAck {
+		t.Fatalf("answered %+v to a contact", ack)
+	}
+	if n := len(hs.sent("Session visitor left ada@example.org as their email address")); n != 1 {
+		t.Errorf("%d notices of the email address", n)
+	}
+	if reply := s.Receive(c, JSONMessage{Type: FrameContact, ID: "m4", Body: "not an address"}); reply == nil || reply.Body != ErrorInvalidEmail {
+		t.Errorf("answered %+v to an invalid address", reply)
+	}
+}
+
+func TestOnlineMessagesSkipInbox(t *testing.T) {
+	s, hs := newOfflineServer(t)
+	setPresence(s.Mautrix_client, mevent.PresenceOnline, agent)
+	c, done := listenTestClient(t, s, newFakeTransport(), "visitor")
+	defer func() {
+		c.Close()
+		waitFor(t, done, "the client to stop")
+	}()
+
+	s.Receive(c, JSONMessage{ID: "m1", Body: "Anyone there?"})
+	eventually(t, func() bool { return len(hs.sent("/createRoom")) == 1 }, "the visitor's room")
+	if n := len(hs.sent("!inbox:example.org")); n != 0 {
+		t.Errorf("%d requests to the inbox with an agent online", n)
+	}
+}
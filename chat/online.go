@@ -0,0 +1,72 @@
+package chat
+
+import (
+	"sync"
+	"time"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+// How long a visitor may go without sockets, e.g. while following a link on
+// the site, before agents are told they left
+var offlineGrace = 15 * time.Second
+
+// Tells agents, with a notice in the room, when a visitor opens their first
+// socket and when their last one has stayed closed for offlineGrace. Only the
+// sockets connected to this instance are counted
+type VisitorsOnline struct {
+	mutex  sync.Mutex
+	online map[string]bool        // sessions announced as online
+	gone   map[string]*time.Timer // pending offline notices
+}
+
+func NewVisitorsOnline() *VisitorsOnline {
+	return &VisitorsOnline{
+		online: make(map[string]bool),
+		gone:   make(map[string]*time.Timer),
+	}
+}
+
+// The session's first socket opened. Without a room yet there's nobody to
+// tell, its creation is the news
+func (v *VisitorsOnline) connected(s *Server, sessid string, room mid.RoomID) {
+	v.mutex.Lock()
+	if timer := v.gone[sessid]; timer != nil {
+		timer.Stop()
+		delete(v.gone, sessid)
+	}
+	announce := !v.online[sessid]
+	v.online[sessid] = true
+	v.mutex.Unlock()
+
+	if announce && room != "" {
+		go s.Mautrix_client.SendNotice(room, "The visitor is online")
+	}
+}
+
+// The session's last socket closed
+func (v *VisitorsOnline) disconnected(s *Server, sessid string, room mid.RoomID) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if timer := v.gone[sessid]; timer != nil {
+		timer.Stop()
+	}
+	v.gone[sessid] = time.AfterFunc(offlineGrace, func() { v.left(s, sessid, room) })
+}
+
+func (v *VisitorsOnline) left(s *Server, sessid string, room mid.RoomID) {
+	v.mutex.Lock()
+	delete(v.gone, sessid)
+	// back in the meantime
+	if s.registry.Get(sessid) != nil {
+		v.mutex.Unlock()
+		return
+	}
+	announce := v.online[sessid]
+	delete(v.online, sessid)
+	v.mutex.Unlock()
+
+	if announce && room != "" {
+		s.Mautrix_client.SendNotice(room, "The visitor went offline")
+	}
+}
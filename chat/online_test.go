@@ -0,0 +1,52 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestVisitorOnlineNotices(t *testing.T) {
+	s := newTestServer(t)
+	hs := newFakeHomeserver(t, s)
+	grace := offlineGrace
+	offlineGrace = 50 * time.Millisecond
+	t.Cleanup(func() { offlineGrace = grace })
+	session := newTestSession(t, "visitor", "!room:example.org")
+	notices := func(text string) func() int {
+		return func() int { return len(hs.sent(text)) }
+	}
+	online, offline := notices("The visitor is online"), notices("The visitor went offline")
+
+	first := NewClient(newFakeTransport(), context.Background(), s, session)
+	second := NewClient(newFakeTransport(), context.Background(), s, session)
+	s.Add(first)
+	s.Add(second)
+	eventually(t, func() bool { return online() == 1 }, "the online notice")
+
+	// one tab of two closes
+	first.Close()
+	time.Sleep(4 * offlineGrace)
+	if n := offline(); n != 0 {
+		t.Fatalf("%d offline notices with a socket left", n)
+	}
+
+	// following a link closes the last socket for a moment
+	second.Close()
+	third := NewClient(newFakeTransport(), context.Background(), s, session)
+	s.Add(third)
+	time.Sleep(4 * offlineGrace)
+	if online() != 1 || offline() != 0 {
+		t.Fatalf("%d online and %d offline notices for a reconnection", online(), offline())
+	}
+
+	third.Close()
+	eventually(t, func() bool { return offline() == 1 }, "the offline notice")
+
+	// and back
+	fourth := NewClient(newFakeTransport(), context.Background(), s, session)
+	s.Add(fourth)
+	eventually(t, func() bool { return online() == 2 }, "the second online notice")
+	fourth.Close()
+	eventually(t, func() bool { return offline() == 2 }, "the second offline notice")
+}
@@ -0,0 +1,138 @@
+package chat
+
+import (
+	"sync"
+	"time"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// How long a presence fetched from the homeserver is trusted. Those the sync
+// tells about are renewed as they change
+const presenceTTL = time.Minute
+
+// Presence of the users the bot shares rooms with, kept up to date by the
+// Matrix sync, or fetched for the users it didn't tell about
+type Presences struct {
+	mutex   sync.Mutex
+	known   map[mid.UserID]presence
+	changed func(user mid.UserID, state mevent.Presence)
+}
+
+type presence struct {
+	state mevent.Presence
+	at    time.Time
+}
+
+func NewPresences() *Presences {
+	return &Presences{known: make(map[mid.UserID]presence)}
+}
+
+// Remembers the user's presence, calling the hook if notify and it changed
+func (p *Presences) set(user mid.UserID, state mevent.Presence, notify bool) {
+	p.mutex.Lock()
+	previous := p.known[user]
+	p.known[user] = presence{state, time.Now()}
+	changed := p.changed
+	p.mutex.Unlock()
+	if notify && changed != nil && previous.state != state {
+		changed(user, state)
+	}
+}
+
+// The user's presence, if it's known and recent enough
+func (p *Presences) get(user mid.UserID) (mevent.Presence, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	known, ok := p.known[user]
+	if !ok || time.Since(known.at) > presenceTTL {
+		return "", false
+	}
+	return known.state, true
+}
+
+// Calls fn whenever the sync tells that a user's presence changed. Only the
+// instance syncing with Matrix does
+func (b *BotPlexer) OnPresence(fn func(user mid.UserID, state mevent.Presence)) {
+	b.presences.mutex.Lock()
+	defer b.presences.mutex.Unlock()
+	b.presences.changed = fn
+}
+
+// Handles the presence events of the sync
+func (b *BotPlexer) handlePresence(evt *mevent.Event) {
+	b.presences.set(evt.Sender, evt.Content.AsPresence().Presence, true)
+}
+
+// The user's presence, fetched from the homeserver unless the sync told about
+// it. Homeservers may not share presence, then everybody is online
+func (b *BotPlexer) Presence(user mid.UserID) mevent.Presence {
+	if state, ok := b.presences.get(user); ok {
+		return state
+	}
+	state := mevent.PresenceOnline
+	if b.client == nil {
+		// not logged in yet
+		return state
+	}
+	if resp, err := b.client.GetPresence(user); err == nil {
+		state = resp.Presence
+	}
+	b.presences.set(user, state, false)
+	return state
+}
+
+// Whether agents are online, as this instance last told the widgets
+type AgentStatus struct {
+	mutex  sync.Mutex
+	status string
+}
+
+func NewAgentStatus() *AgentStatus {
+	return &AgentStatus{}
+}
+
+// Records the status, returning whether it changed
+func (a *AgentStatus) update(status string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	changed := status != a.status
+	a.status = status
+	return changed
+}
+
+// Whether any agent who may be offered conversations isn't offline
+func (s *Server) AgentsOnline() bool {
+	agents := []mid.UserID{s.Mautrix_client.Recipient()}
+	if pool := s.routing.Agents(); len(pool) > 0 {
+		agents = agents[:0]
+		for _, agent := range pool {
+			agents = append(agents, agent.ID)
+		}
+	}
+	for _, agent := range agents {
+		if s.Mautrix_client.Presence(agent) != mevent.PresenceOffline {
+			return true
+		}
+	}
+	return false
+}
+
+// Frame telling the widget whether agents are online
+func (s *Server) statusFrame() *JSONMessage {
+	status := StatusOffline
+	if s.AgentsOnline() {
+		status = StatusOnline
+	}
+	return &JSONMessage{Type: FrameStatus, Body: status}
+}
+
+// Tells every widget when the last agent goes offline, or the first one comes
+// back online
+func (s *Server) presenceChanged(user mid.UserID, state mevent.Presence) {
+	frame := s.statusFrame()
+	if s.status.update(frame.Body) {
+		s.publish(&SessionEvent{Frame: frame})
+	}
+}
@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// Status frames the transport was sent
+func statusFrames(transport *fakeTransport) []string {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	found := []string{}
+	for _, msg := range transport.sent {
+		if msg.Type == FrameStatus {
+			found = append(found, msg.Body)
+		}
+	}
+	return found
+}
+
+func TestPresencesExpire(t *testing.T) {
+	p := NewPresences()
+	notified := 0
+	p.changed = func(user mid.UserID, state mevent.Presence) { notified++ }
+	p.set(alice, mevent.PresenceOnline, true)
+	p.set(alice, mevent.PresenceOnline, true)
+	p.set(bob, mevent.PresenceOffline, false)
+	if notified != 1 {
+		t.Errorf("notified %d times, want once for alice coming online", notified)
+	}
+	if state, ok := p.get(alice); !ok || state != mevent.PresenceOnline {
+		t.Errorf("alice is %q, known %v", state, ok)
+	}
+	p.known[bob] = presence{mevent.PresenceOffline, time.Now().Add(-2 * presenceTTL)}
+	if _, ok := p.get(bob); ok {
+		t.Error("an old presence is still trusted")
+	}
+}
+
+func TestPresenceChangedTellsWidgets(t *testing.T) {
+	s := newTestServer(t)
+	s.routing = newTestRouting(t, RouteRoundRobin)
+	s.Mautrix_client.OnPresence(s.presenceChanged)
+	setPresence(s.Mautrix_client, mevent.PresenceOffline, alice, bob, carol)
+	transport := newFakeTransport()
+	c, done := listenTestClient(t, s, transport, "visitor")
+	defer func() {
+		c.Close()
+		waitFor(t, done, "the client to stop")
+	}()
+
+	presences := s.Mautrix_client.presences
+	presences.set(alice, mevent.PresenceOnline, true)
+	eventually(t, func() bool { return len(statusFrames(transport)) == 1 }, "the online status")
+	// more agents online, or fewer while some are left, change nothing
+	presences.set(bob, mevent.PresenceUnavailable, true)
+	presences.set(alice, mevent.PresenceOffline, true)
+	presences.set(bob, mevent.PresenceOffline, true)
+	eventually(t, func() bool { return len(statusFrames(transport)) == 2 }, "the offline status")
+	time.Sleep(50 * time.Millisecond)
+	if frames := statusFrames(transport); len(frames) != 2 || frames[0] != StatusOnline || frames[1] != StatusOffline {
+		t.Errorf("status frames %v, want online then offline", frames)
+	}
+}
@@ -0,0 +1,202 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+// How long agents' profiles, and their avatars, are cached
+const profileTTL = time.Hour
+
+// Largest avatar proxied, and how many are kept in memory
+const (
+	maxAvatarSize  = 1 << 20
+	maxAvatarCache = 256
+)
+
+// How long a path no agent's avatar is at is answered from memory
+const missingAvatarTTL = time.Minute
+
+// Server name and media ID of a proxied avatar's path
+var mediaPattern = regexp.MustCompile(`^([A-Za-z0-9.-]+|\[[0-9A-Fa-f:.]+\])(:[0-9]{1,5})?/[A-Za-z0-9_-]+$`)
+
+// What the widget shows of the agent who wrote a message
+type Profile struct {
+	Name   string
+	Avatar string // path of the avatar on this server, empty if none
+}
+
+// Agents' Matrix profiles, cached, with names configured for privacy instead
+// of theirs. Avatars are proxied by the server so that visitors never reach
+// the homeserver, only those of agents are
+type Profiles struct {
+	mutex     sync.Mutex
+	prefix    string // of the avatars' paths
+	names     map[mid.UserID]string
+	avatars   bool
+	known     map[mid.UserID]cachedProfile
+	media     map[string]mid.ContentURI // avatars that may be proxied, by path
+	missing   map[string]time.Time      // paths found to be no avatar, and when
+	downloads map[string]*avatar
+}
+
+type cachedProfile struct {
+	profile Profile
+	at      time.Time
+}
+
+type avatar struct {
+	data        []byte
+	contentType string
+	at          time.Time
+}
+
+// Parses names agents are shown with, separated by commas, each a Matrix ID
+// followed by = and the name, as in "@alice.smith:example.org=Alice"
+func ParseAgentNames(list string) (map[mid.UserID]string, error) {
+	names := make(map[mid.UserID]string)
+	for _, entry := range strings.Split(list, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		agent := mid.UserID(strings.TrimSpace(parts[0]))
+		if _, _, err := agent.Parse(); err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("%q should be a Matrix ID and a name", strings.TrimSpace(entry))
+		}
+		names[agent] = strings.TrimSpace(parts[1])
+	}
+	return names, nil
+}
+
+// Hiding avatars only shows names
+func NewProfiles(names map[mid.UserID]string, avatars bool) *Profiles {
+	return &Profiles{
+		names:     names,
+		avatars:   avatars,
+		known:     make(map[mid.UserID]cachedProfile),
+		media:     make(map[string]mid.ContentURI),
+		missing:   make(map[string]time.Time),
+		downloads: make(map[string]*avatar),
+	}
+}
+
+// The agent's profile, from the cache unless it's too old
+func (p *Profiles) Get(b *BotPlexer, agent mid.UserID) Profile {
+	p.mutex.Lock()
+	cached, ok := p.known[agent]
+	p.mutex.Unlock()
+	if ok && time.Since(cached.at) < profileTTL {
+		return cached.profile
+	}
+
+	profile := Profile{Name: p.names[agent]}
+	if profile.Name == "" {
+		profile.Name = b.DisplayName(agent)
+	}
+	var uri mid.ContentURI
+	if p.avatars {
+		var err error
+		if uri, err = b.AvatarURL(agent); err != nil {
+			log.Printf("Could not get the avatar of %s: %s", agent, err)
+		} else if !uri.IsEmpty() {
+			profile.Avatar = p.prefix + uri.Homeserver + "/" + uri.FileID
+		}
+	}
+	p.mutex.Lock()
+	p.known[agent] = cachedProfile{profile, time.Now()}
+	if profile.Avatar != "" {
+		p.media[profile.Avatar] = uri
+		delete(p.missing, profile.Avatar)
+	}
+	p.mutex.Unlock()
+	if profile.Avatar != "" {
+		// for the other instances, fails harmlessly when it's already stored
+		if _, err := DB.GetDB().Exec("INSERT INTO Avatar (path) VALUES (?)", profile.Avatar); err != nil && !isConflict(err) {
+			log.Println("Could not store avatar:", err)
+		}
+	}
+	return profile
+}
+
+// Serves the avatars of agents, downloaded from the homeserver once in a while
+func (s *Server) serveAvatar(w http.ResponseWriter, r *http.Request) {
+	p := s.profiles
+	p.mutex.Lock()
+	uri, ok := p.media[r.URL.Path]
+	cached := p.downloads[r.URL.Path]
+	missing, isMissing := p.missing[r.URL.Path]
+	p.mutex.Unlock()
+	if !ok {
+		if isMissing && time.Since(missing) < missingAvatarTTL {
+			http.NotFound(w, r)
+			return
+		}
+		// resolved by another instance
+		uri, ok = storedAvatar(p.prefix, r.URL.Path)
+		if !ok {
+			p.mutex.Lock()
+			if len(p.missing) >= maxAvatarCache {
+				for path := range p.missing {
+					delete(p.missing, path)
+					break
+				}
+			}
+			p.missing[r.URL.Path] = time.Now()
+			p.mutex.Unlock()
+			http.NotFound(w, r)
+			return
+		}
+		p.mutex.Lock()
+		p.media[r.URL.Path] = uri
+		p.mutex.Unlock()
+	}
+	if cached == nil || time.Since(cached.at) > profileTTL {
+		data, err := s.Mautrix_client.Download(uri)
+		if err != nil {
+			log.Printf("Could not download %s: %s", uri, err)
+			http.Error(w, "Could not get the avatar", http.StatusBadGateway)
+			return
+		}
+		contentType := http.DetectContentType(data)
+		if len(data) > maxAvatarSize || !strings.HasPrefix(contentType, "image/") {
+			http.NotFound(w, r)
+			return
+		}
+		cached = &avatar{data, contentType, time.Now()}
+		p.mutex.Lock()
+		if len(p.downloads) >= maxAvatarCache {
+			for path := range p.downloads {
+				delete(p.downloads, path)
+				break
+			}
+		}
+		p.downloads[r.URL.Path] = cached
+		p.mutex.Unlock()
+	}
+	w.Header().Set("Content-Type", cached.contentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(profileTTL.Seconds())))
+	w.Write(cached.data)
+}
+
+// The avatar at the path, if it's an agent's one any instance proxied
+func storedAvatar(prefix, path string) (mid.ContentURI, bool) {
+	media := strings.TrimPrefix(path, prefix)
+	if media == path || !mediaPattern.MatchString(media) {
+		return mid.ContentURI{}, false
+	}
+	var count int
+	row := DB.GetDB().QueryRow("SELECT COUNT(*) FROM Avatar WHERE path = ?", path)
+	if err := row.Scan(&count); err != nil || count == 0 {
+		return mid.ContentURI{}, false
+	}
+	parts := strings.SplitN(media, "/", 2)
+	return mid.ContentURI{Homeserver: parts[0], FileID: parts[1]}, true
+}
@@ -0,0 +1,116 @@
+package chat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+func TestStoredAvatar(t *testing.T) {
+	newTestServer(t)
+	paths := []string{
+		"/entry/avatar/example.org/AbCd_12-x",
+		"/entry/avatar/example.org/AbCd/../../secret",
+		"/entry/avatar/example.org/",
+		"/entry/avatar/example.org:8448/AbCd",
+		"/entry/avatar/[2001:db8::1]:8448/AbCd",
+		"/entry/avatar/evil.org?x=/AbCd",
+		"/other/example.org/AbCd",
+	}
+	for _, path := range paths {
+		if _, err := DB.GetDB().Exec("INSERT INTO Avatar (path) VALUES (?)", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path string
+		uri  mid.ContentURI
+		ok   bool
+	}{
+		{"/entry/avatar/example.org/AbCd_12-x", mid.ContentURI{Homeserver: "example.org", FileID: "AbCd_12-x"}, true},
+		{"/entry/avatar/example.org:8448/AbCd", mid.ContentURI{Homeserver: "example.org:8448", FileID: "AbCd"}, true},
+		{"/entry/avatar/[2001:db8::1]:8448/AbCd", mid.ContentURI{Homeserver: "[2001:db8::1]:8448", FileID: "AbCd"}, true},
+		{"/entry/avatar/example.org/AbCd/../../secret", mid.ContentURI{}, false},
+		{"/entry/avatar/example.org/", mid.ContentURI{}, false},
+		{"/entry/avatar/evil.org?x=/AbCd", mid.ContentURI{}, false},
+		{"/other/example.org/AbCd", mid.ContentURI{}, false},
+		// well formed but no agent's
+		{"/entry/avatar/example.org/Unknown", mid.ContentURI{}, false},
+	}
+	for _, test := range tests {
+		uri, ok := storedAvatar("/entry/avatar/", test.path)
+		if ok != test.ok || uri != test.uri {
+			t.Errorf("storedAvatar(%q) = %v, %v, want %v, %v", test.path, uri, ok, test.uri, test.ok)
+		}
+	}
+}
+
+func TestServeAvatarCachesMissing(t *testing.T) {
+	s := newTestServer(t)
+	newFakeHomeserver(t, s)
+	path := "/entry/avatar/example.org/AbCd"
+	serve := func() int {
+		w := httptest.NewRecorder()
+		s.serveAvatar(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	if code := serve(); code != http.StatusNotFound {
+		t.Fatalf("unknown avatar answered %d", code)
+	}
+	if _, err := DB.GetDB().Exec("INSERT INTO Avatar (path) VALUES (?)", path); err != nil {
+		t.Fatal(err)
+	}
+	// answered from memory, without looking again
+	if code := serve(); code != http.StatusNotFound {
+		t.Fatalf("cached miss answered %d", code)
+	}
+	s.profiles.mutex.Lock()
+	s.profiles.missing[path] = time.Now().Add(-2 * missingAvatarTTL)
+	s.profiles.mutex.Unlock()
+	serve()
+	s.profiles.mutex.Lock()
+	_, known := s.profiles.media[path]
+	s.profiles.mutex.Unlock()
+	if !known {
+		t.Error("avatar not looked up again once the miss expired")
+	}
+}
+
+func TestTransferNamesAgentAsShown(t *testing.T) {
+	s := newTestServer(t)
+	newFakeHomeserver(t, s)
+	s.profiles = NewProfiles(map[mid.UserID]string{"@alice.smith:example.org": "Alice"}, false)
+	transport := newFakeTransport()
+	c, done := listenTestClient(t, s, transport, "visitor")
+	defer func() {
+		c.Close()
+		<-done
+	}()
+	conv := NewConversation("visitor")
+	conv.Room = "!room:example.org"
+	conv.State = StateAssigned
+	if err := conv.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Transfer("visitor", "@alice.smith:example.org", "@agent:example.org", false); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		transport.mutex.Lock()
+		defer transport.mutex.Unlock()
+		for _, msg := range transport.sent {
+			if msg.Type == FrameSystem && msg.Body == SystemTransfer {
+				if msg.Author != "Alice" {
+					t.Fatalf("transfer to %q, want the configured name", msg.Author)
+				}
+				return true
+			}
+		}
+		return false
+	}, "the transfer frame")
+}
@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Identifies this server instance among the ones sharing the database and the
+// pub/sub backend. Set it before starting the server to override the default
+var InstanceID = defaultInstanceID()
+
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "livematrix"
+	}
+	// containers may share both the hostname and the pid
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		panic(err)
+	}
+	return host + "-" + strconv.Itoa(os.Getpid()) + "-" + hex.EncodeToString(suffix)
+}
+
+// Topic every session event is published on
+const sessionTopic = "livematrix.sessions"
+
+// Fans messages out to every subscriber of a topic, on every instance,
+// including the one publishing them
+type PubSub interface {
+	Publish(topic string, payload []byte) error
+	Subscribe(topic string, handler func(payload []byte)) error
+	Close() error
+}
+
+// Creates the pub/sub backend of the given kind: "memory", the default, only
+// reaches this process, "redis" and "nats" reach every instance connected to
+// the server at url
+func NewPubSub(kind, url string) (PubSub, error) {
+	switch kind {
+	case "", "memory":
+		return NewMemoryPubSub(), nil
+	case "redis":
+		return NewRedisPubSub(url)
+	case "nats":
+		return NewNATSPubSub(url)
+	}
+	return nil, fmt.Errorf("unknown pub/sub backend %q", kind)
+}
+
+// Single instance pub/sub, handlers are called synchronously by Publish
+type MemoryPubSub struct {
+	mutex    sync.RWMutex
+	handlers map[string][]func([]byte)
+}
+
+func NewMemoryPubSub() *MemoryPubSub {
+	return &MemoryPubSub{handlers: make(map[string][]func([]byte))}
+}
+
+func (m *MemoryPubSub) Publish(topic string, payload []byte) error {
+	m.mutex.RLock()
+	handlers := m.handlers[topic]
+	m.mutex.RUnlock()
+	for _, handler := range handlers {
+		handler(payload)
+	}
+	return nil
+}
+
+func (m *MemoryPubSub) Subscribe(topic string, handler func([]byte)) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	handlers := make([]func([]byte), len(m.handlers[topic]), len(m.handlers[topic])+1)
+	copy(handlers, m.handlers[topic])
+	m.handlers[topic] = append(handlers, handler)
+	return nil
+}
+
+func (m *MemoryPubSub) Close() error {
+	return nil
+}
+
+// Something that happened to a session, which every instance holding sockets
+// of that session must know about
+type SessionEvent struct {
+	Origin  string       `json:"origin"`
+	Session string       `json:"session"`
+	Exclude int          `json:"exclude,omitempty"` // socket of Origin not to deliver Frame to
+	Frame   *JSONMessage `json:"frame,omitempty"`   // to deliver to the session's sockets
+	Message *Message     `json:"message,omitempty"` // stored, to append to the history
+	Update  *Message     `json:"update,omitempty"`  // edited or deleted, to replace in the history
+	Room    string       `json:"room,omitempty"`    // the session's room was created
+	Closed  string       `json:"closed,omitempty"`  // the conversation in this room was closed
+	Forget  bool         `json:"forget,omitempty"`  // the session was deleted
+	Kick    string       `json:"kick,omitempty"`    // the session's sockets must be closed, for this reason
+	Purge   string       `json:"purge,omitempty"`   // history before this was purged, on all sessions
+}
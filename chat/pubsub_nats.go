@@ -0,0 +1,38 @@
+package chat
+
+import (
+	"github.com/nats-io/nats.go"
+)
+
+// Pub/sub over NATS subjects, url is of the form nats://host:4222
+type NATSPubSub struct {
+	conn *nats.Conn
+}
+
+func NewNATSPubSub(url string) (*NATSPubSub, error) {
+	conn, err := nats.Connect(url, nats.Name("livematrix "+InstanceID), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &NATSPubSub{conn}, nil
+}
+
+func (n *NATSPubSub) Publish(topic string, payload []byte) error {
+	return n.conn.Publish(topic, payload)
+}
+
+// The handler is called from a single goroutine, in publishing order
+func (n *NATSPubSub) Subscribe(topic string, handler func([]byte)) error {
+	_, err := n.conn.Subscribe(topic, func(msg *nats.Msg) {
+		handler(msg.Data)
+	})
+	if err != nil {
+		return err
+	}
+	return n.conn.Flush()
+}
+
+func (n *NATSPubSub) Close() error {
+	n.conn.Close()
+	return nil
+}
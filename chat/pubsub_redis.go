@@ -0,0 +1,57 @@
+package chat
+
+import (
+	"context"
+	"log"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Pub/sub over Redis channels, url is of the form redis://host:6379/0
+type RedisPubSub struct {
+	client *redis.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewRedisPubSub(url string) (*RedisPubSub, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	client := redis.NewClient(opts)
+	if err := client.Ping(ctx).Err(); err != nil {
+		cancel()
+		client.Close()
+		return nil, err
+	}
+	return &RedisPubSub{client, ctx, cancel}, nil
+}
+
+func (r *RedisPubSub) Publish(topic string, payload []byte) error {
+	return r.client.Publish(r.ctx, topic, payload).Err()
+}
+
+// The handler is called from a single goroutine, in publishing order
+func (r *RedisPubSub) Subscribe(topic string, handler func([]byte)) error {
+	sub := r.client.Subscribe(r.ctx, topic)
+	// wait for the subscription to be confirmed, so no message is missed
+	if _, err := sub.Receive(r.ctx); err != nil {
+		sub.Close()
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for msg := range sub.Channel() {
+			handler([]byte(msg.Payload))
+		}
+		log.Printf("Redis subscription to %s closed", topic)
+	}()
+	return nil
+}
+
+func (r *RedisPubSub) Close() error {
+	r.cancel()
+	return r.client.Close()
+}
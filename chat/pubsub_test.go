@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// Publishes on a and checks that subscribers of a and b both get every
+// payload, in order
+func testRoundTrip(t *testing.T, a, b PubSub) {
+	t.Helper()
+	topic := fmt.Sprintf("livematrix.test.%d", time.Now().UnixNano())
+	gotA, gotB := make(chan string, 10), make(chan string, 10)
+	if err := a.Subscribe(topic, func(payload []byte) { gotA <- string(payload) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Subscribe(topic, func(payload []byte) { gotB <- string(payload) }); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"one", "two", "three"} {
+		if err := a.Publish(topic, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, got := range map[string]chan string{"publisher": gotA, "other instance": gotB} {
+		for _, want := range []string{"one", "two", "three"} {
+			select {
+			case payload := <-got:
+				if payload != want {
+					t.Errorf("%s got %q, want %q", name, payload, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s did not get %q", name, want)
+			}
+		}
+	}
+}
+
+func TestMemoryPubSub(t *testing.T) {
+	m := NewMemoryPubSub()
+	testRoundTrip(t, m, m)
+}
+
+func TestRedisPubSub(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+	a, err := NewRedisPubSub(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewRedisPubSub(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	testRoundTrip(t, a, b)
+}
+
+func TestNATSPubSub(t *testing.T) {
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		t.Skip("NATS_URL is not set")
+	}
+	a, err := NewNATSPubSub(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewNATSPubSub(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	testRoundTrip(t, a, b)
+}
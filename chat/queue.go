@@ -0,0 +1,264 @@
+package chat
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+// How often the leader offers queued conversations to agents with capacity
+const queueInterval = 5 * time.Second
+
+// Conversations recently closed the estimated wait is averaged over
+const waitSample = 20
+
+// Sessions waiting, first come first served, for an agent with capacity
+// before their room is created. Queued conversations are kept in the
+// Conversation table, so that any instance may be the leader dequeuing them
+type Queue struct {
+	Capacity  int // conversations not closed per agent, zero disables the queue
+	mutex     sync.Mutex
+	positions map[string]int // last told to each session
+}
+
+func NewQueue(capacity int) *Queue {
+	return &Queue{Capacity: capacity, positions: make(map[string]int)}
+}
+
+func (q *Queue) enabled() bool {
+	return q != nil && q.Capacity > 0
+}
+
+// Agents who have as many conversations not closed as they can take
+func (s *Server) fullAgents() (map[mid.UserID]bool, error) {
+	active, err := activeConversations()
+	if err != nil {
+		return nil, err
+	}
+	full := make(map[mid.UserID]bool)
+	for agent, count := range active {
+		if count >= s.queue.Capacity {
+			full[mid.UserID(agent)] = true
+		}
+	}
+	return full, nil
+}
+
+// The agent to offer a session's conversation to, among those with capacity
+// when the queue is enabled. False if every one of them is full
+func (s *Server) pickAgent(sessid string) (mid.UserID, bool) {
+	if !s.queue.enabled() {
+		return s.routing.Pick(s.Mautrix_client, SessionTags(sessid), nil), true
+	}
+	full, err := s.fullAgents()
+	if err != nil {
+		log.Println("Could not count conversations:", err)
+		return "", false
+	}
+	if len(s.routing.Agents()) == 0 {
+		return "", !full[s.Mautrix_client.Recipient()]
+	}
+	agent := s.routing.Pick(s.Mautrix_client, SessionTags(sessid), full)
+	return agent, agent != ""
+}
+
+// Conversations queued, zero unless the queue is enabled
+func (s *Server) queueLength() int {
+	if !s.queue.enabled() {
+		return 0
+	}
+	var count int
+	row := DB.GetDB().QueryRow("SELECT COUNT(*) FROM Conversation WHERE state = ?", StateQueued)
+	if err := row.Scan(&count); err != nil {
+		log.Println("Could not count queued conversations:", err)
+	}
+	return count
+}
+
+// Queued conversations, first come first
+func queuedConversations() ([]*Conversation, error) {
+	rows, err := DB.GetDB().Query("SELECT id, session, room, state, agent, opened, closed, closed_by FROM Conversation WHERE state = ? ORDER BY id", StateQueued)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	queued := []*Conversation{}
+	for rows.Next() {
+		c := &Conversation{}
+		if err := rows.Scan(&c.Id, &c.Session, &c.Room, &c.State, &c.Agent, &c.Opened, &c.Closed, &c.ClosedBy); err != nil {
+			return nil, err
+		}
+		queued = append(queued, c)
+	}
+	return queued, rows.Err()
+}
+
+// Puts a conversation at the end of the queue, unless it's queued already
+func (s *Server) enqueue(conv *Conversation) {
+	if conv.State != StateQueued {
+		conv.State = StateQueued
+		if err := conv.Save(); err != nil {
+			log.Println("Could not queue conversation:", err)
+			return
+		}
+		log.Printf("Session %s is queued", conv.Session)
+	}
+	if frame := s.queueFrame(conv.Session); frame != nil {
+		// the leader tells it again once it moves
+		s.queue.mutex.Lock()
+		s.queue.positions[conv.Session] = frame.Position
+		s.queue.mutex.Unlock()
+		s.publish(&SessionEvent{Session: conv.Session, Frame: frame})
+	}
+}
+
+// Frame telling the session its position in the queue and the estimated wait,
+// nil if it isn't queued
+func (s *Server) queueFrame(sessid string) *JSONMessage {
+	if !s.queue.enabled() {
+		return nil
+	}
+	queued, err := queuedConversations()
+	if err != nil {
+		log.Println("Could not list queued conversations:", err)
+		return nil
+	}
+	for i, conv := range queued {
+		if conv.Session == sessid {
+			return &JSONMessage{Type: FrameQueue, Position: i + 1, Wait: s.estimateWait(i + 1)}
+		}
+	}
+	return nil
+}
+
+// Seconds the visitor at that position in the queue should wait, from how
+// long recent conversations lasted, zero if there's no telling
+func (s *Server) estimateWait(position int) int {
+	rows, err := DB.GetDB().Query("SELECT opened, closed FROM Conversation WHERE state = ? AND closed_by != ? ORDER BY id DESC LIMIT ?",
+		StateClosed, ClosedByInactivity, waitSample)
+	if err != nil {
+		return 0
+	}
+	defer rows.Close()
+	var total time.Duration
+	count := 0
+	for rows.Next() {
+		var opened, closed string
+		if err := rows.Scan(&opened, &closed); err != nil {
+			return 0
+		}
+		from, err1 := time.Parse(TimeFormat, opened)
+		to, err2 := time.Parse(TimeFormat, closed)
+		if err1 == nil && err2 == nil && to.After(from) {
+			total += to.Sub(from)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	agents := len(s.routing.Agents())
+	if agents == 0 {
+		agents = 1
+	}
+	average := total / time.Duration(count)
+	return int((average * time.Duration(position) / time.Duration(agents*s.queue.Capacity)).Seconds())
+}
+
+// Offers, once every queueInterval, the queued conversations to agents with
+// capacity, in order, and tells the ones still waiting where they stand. Only
+// the leader does
+func (s *Server) RunQueue() {
+	if !s.queue.enabled() {
+		return
+	}
+	ticker := time.NewTicker(queueInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.Mautrix_client.IsLeader() {
+			s.dequeue()
+		}
+	}
+}
+
+func (s *Server) dequeue() {
+	queued, err := queuedConversations()
+	if err != nil {
+		log.Println("Could not list queued conversations:", err)
+		return
+	}
+	for len(queued) > 0 {
+		agent, ok := s.pickAgent(queued[0].Session)
+		if !ok {
+			break
+		}
+		conv := queued[0]
+		queued = queued[1:]
+		session := NewSession(nil, nil)
+		if err := DB.GetByPk(session, conv.Session, "session"); err != nil {
+			log.Println("Could not load session:", err)
+			continue
+		}
+		if claimed, err := ClaimRoom(conv.Session); err != nil || !claimed {
+			continue
+		}
+		room, err := s.openRoom(session, conv, agent)
+		ReleaseRoom(conv.Session)
+		if err != nil {
+			log.Printf("Could not open the room of %s: %s", conv.Session, err)
+			break
+		}
+		s.publish(&SessionEvent{Session: conv.Session, Frame: &JSONMessage{Type: FrameQueue}})
+		s.relayPending(conv.Session, room)
+	}
+
+	positions := make(map[string]int)
+	moved := []string{}
+	s.queue.mutex.Lock()
+	for i, conv := range queued {
+		positions[conv.Session] = i + 1
+		if s.queue.positions[conv.Session] != i+1 {
+			moved = append(moved, conv.Session)
+		}
+	}
+	s.queue.positions = positions
+	s.queue.mutex.Unlock()
+	for _, sessid := range moved {
+		position := positions[sessid]
+		frame := &JSONMessage{Type: FrameQueue, Position: position, Wait: s.estimateWait(position)}
+		s.publish(&SessionEvent{Session: sessid, Frame: frame})
+	}
+}
+
+// Whether the session's conversation waits in the queue
+func (s *Server) queued(sessid string) bool {
+	if !s.queue.enabled() {
+		return false
+	}
+	conv, err := CurrentConversation(sessid)
+	return err == nil && conv != nil && conv.State == StateQueued
+}
+
+// Relays to the room the visitor's messages written while they were queued
+func (s *Server) relayPending(sessid string, room mid.RoomID) {
+	messages, err := LoadMessages(sessid)
+	if err != nil {
+		log.Println("Could not load messages:", err)
+		return
+	}
+	for _, msg := range messages {
+		if *msg.Author == "0" || *msg.EventID != "" {
+			continue
+		}
+		content := s.formatting.VisitorContent(*msg.Body)
+		resp, err := s.Mautrix_client.SendMessage(room, &content, msg.TxnID())
+		if err != nil {
+			continue
+		}
+		if err := msg.SetEventID(room, resp.EventID); err != nil {
+			log.Println("Could not store message event:", err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	mevent "maunium.net/go/mautrix/event"
+)
+
+// Queue frames the transport was sent
+func queueFrames(transport *fakeTransport) []JSONMessage {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	found := []JSONMessage{}
+	for _, msg := range transport.sent {
+		if msg.Type == FrameQueue {
+			found = append(found, *msg)
+		}
+	}
+	return found
+}
+
+// Server with a queue, whose agent is online
+func newQueueServer(t *testing.T, capacity int) (*Server, *fakeHomeserver) {
+	t.Helper()
+	s := newTestServer(t)
+	hs := newFakeHomeserver(t, s)
+	s.queue = NewQueue(capacity)
+	*s.Mautrix_client.recipient = agent.String()
+	setPresence(s.Mautrix_client, mevent.PresenceOnline, agent)
+	return s, hs
+}
+
+func TestQueuePositions(t *testing.T) {
+	s, hs := newQueueServer(t, 1)
+	clients := map[string]*Client{}
+	transports := map[string]*fakeTransport{}
+	for _, sessid := range []string{"visitor-1", "visitor-2", "visitor-3", "visitor-4"} {
+		transports[sessid] = newFakeTransport()
+		c, done := listenTestClient(t, s, transports[sessid], sessid)
+		defer func() {
+			c.Close()
+			waitFor(t, done, "the client to stop")
+		}()
+		clients[sessid] = c
+		s.setupRoom(c, s.registry.Get(sessid), true)
+	}
+
+	// the agent takes the first conversation, the others wait in turn
+	if n := len(hs.sent("/createRoom")); n != 1 {
+		t.Fatalf("%d rooms created for an agent taking one conversation", n)
+	}
+	if s.queued("visitor-1") || !s.queued("visitor-2") || s.queueLength() != 3 {
+		t.Fatalf("%d queued", s.queueLength())
+	}
+	for position, sessid := range []string{"visitor-2", "visitor-3", "visitor-4"} {
+		sessid, position := sessid, position+1
+		eventually(t, func() bool {
+			frames := queueFrames(transports[sessid])
+			return len(frames) == 1 && frames[0].Position == position
+		}, sessid+" told its position")
+	}
+	s.Receive(clients["visitor-2"], JSONMessage{ID: "m1", Body: "Still waiting"})
+	if n := len(hs.sent("Still waiting")); n != 0 {
+		t.Fatalf("relayed %d messages of a queued visitor", n)
+	}
+
+	// the agent is full until the first conversation is closed
+	s.dequeue()
+	if n := len(hs.sent("/createRoom")); n != 1 || s.queueLength() != 3 {
+		t.Fatalf("%d rooms created and %d queued for a full agent", n, s.queueLength())
+	}
+	if err := s.CloseConversation("visitor-1", ClosedByAgent); err != nil {
+		t.Fatal(err)
+	}
+	s.dequeue()
+	if n := len(hs.sent("/createRoom")); n != 2 || s.queued("visitor-2") || s.queueLength() != 2 {
+		t.Fatalf("%d rooms created and %d queued once the agent was free", n, s.queueLength())
+	}
+	if n := len(hs.sent("Still waiting")); n != 1 {
+		t.Errorf("relayed %d messages written while queued, want 1", n)
+	}
+	eventually(t, func() bool {
+		frames := queueFrames(transports["visitor-2"])
+		return len(frames) == 2 && frames[1].Position == 0
+	}, "visitor-2 told it left the queue")
+	for position, sessid := range []string{"visitor-3", "visitor-4"} {
+		sessid, position := sessid, position+1
+		eventually(t, func() bool {
+			frames := queueFrames(transports[sessid])
+			return len(frames) == 2 && frames[1].Position == position
+		}, sessid+" told it moved up")
+	}
+
+	// positions which didn't change aren't told again
+	s.dequeue()
+	time.Sleep(50 * time.Millisecond)
+	for _, sessid := range []string{"visitor-3", "visitor-4"} {
+		if n := len(queueFrames(transports[sessid])); n != 2 {
+			t.Errorf("%s told its position %d times", sessid, n)
+		}
+	}
+}
+
+func TestEstimateWait(t *testing.T) {
+	s, _ := newQueueServer(t, 2)
+	if wait := s.estimateWait(1); wait != 0 {
+		t.Errorf("estimated %ds without any conversation", wait)
+	}
+	now := time.Now().UTC()
+	for _, c := range []struct {
+		minutes  int
+		closedBy string
+	}{{10, ClosedByAgent}, {20, ClosedByVisitor}, {300, ClosedByInactivity}} {
+		conv := &Conversation{Session: "past", State: StateClosed, ClosedBy: c.closedBy,
+			Opened: now.Add(-time.Duration(c.minutes) * time.Minute).Format(TimeFormat), Closed: now.Format(TimeFormat)}
+		if err := conv.Create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 15 minutes on average, the idle one left out, two at a time
+	if wait := s.estimateWait(3); wait != 3*15*60/2 {
+		t.Errorf("estimated %ds for the third in the queue", wait)
+	}
+}
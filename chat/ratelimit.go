@@ -0,0 +1,246 @@
+package chat
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Rejections by the rate limits, served by the admin API for monitoring
+var limitCounters = &Counters{counts: make(map[string]int64)}
+
+// Counts by name, safe for concurrent use
+type Counters struct {
+	mutex  sync.Mutex
+	counts map[string]int64
+}
+
+func (c *Counters) Add(name string, delta int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counts[name] += delta
+}
+
+// A copy of the counts
+func (c *Counters) Snapshot() map[string]int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	counts := make(map[string]int64, len(c.counts))
+	for name, count := range c.counts {
+		counts[name] = count
+	}
+	return counts
+}
+
+// Token buckets sharing a rate, one per key. Each holds at most rate tokens,
+// and gets rate of them back every per. Buckets full again are forgotten
+type Limiter struct {
+	mutex   sync.Mutex
+	rate    int
+	per     time.Duration
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A zero rate doesn't limit anything
+func NewLimiter(rate int, per time.Duration) *Limiter {
+	return &Limiter{rate: rate, per: per, buckets: make(map[string]*bucket), swept: time.Now()}
+}
+
+// Takes a token from the key's bucket, if there's one left
+func (l *Limiter) Allow(key string) bool {
+	if l == nil || l.rate <= 0 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) > l.per {
+		for k, b := range l.buckets {
+			if l.refill(b, now) >= float64(l.rate) {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{float64(l.rate), now}
+		l.buckets[key] = b
+	}
+	if l.refill(b, now) < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	b.tokens += float64(l.rate) * now.Sub(b.last).Seconds() / l.per.Seconds()
+	if b.tokens > float64(l.rate) {
+		b.tokens = float64(l.rate)
+	}
+	b.last = now
+	return b.tokens
+}
+
+// Limits keeping a script from getting the bot rate limited by the homeserver.
+// They're kept by each instance, for the sockets it holds
+type RateLimits struct {
+	Sessions  *Limiter // sessions created, per IP address
+	Messages  *Limiter // frames relayed to Matrix, per session
+	Rooms     *Limiter // rooms created, across sessions
+	MaxLength int      // of a message, in characters
+}
+
+// Rates of zero are unlimited
+func NewRateLimits(sessionsPerHour, messagesPerMinute, roomsPerMinute, maxLength int) *RateLimits {
+	return &RateLimits{
+		NewLimiter(sessionsPerHour, time.Hour),
+		NewLimiter(messagesPerMinute, time.Minute),
+		NewLimiter(roomsPerMinute, time.Minute),
+		maxLength,
+	}
+}
+
+// Error codes of the error frames answering a rejected frame
+const (
+	ErrorRateLimited  = "rate_limited"
+	ErrorTooLong      = "too_long"
+	ErrorInvalidEmail = "invalid_email"
+)
+
+// Checks a frame the visitor wants relayed to Matrix, returning the error
+// frame to answer it with if it's rejected
+func (l *RateLimits) check(sessid string, msg *JSONMessage) *JSONMessage {
+	if l == nil {
+		return nil
+	}
+	if l.MaxLength > 0 && utf8.RuneCountInString(msg.Body) > l.MaxLength {
+		limitCounters.Add("too_long", 1)
+		return &JSONMessage{Type: FrameError, ID: msg.ID, Body: ErrorTooLong}
+	}
+	if !l.Messages.Allow(sessid) {
+		limitCounters.Add("messages", 1)
+		return &JSONMessage{Type: FrameError, ID: msg.ID, Body: ErrorRateLimited}
+	}
+	return nil
+}
+
+// Waits, up to timeout, for a room to be allowed
+func (l *RateLimits) waitRoom(timeout time.Duration) bool {
+	if l == nil {
+		return true
+	}
+	deadline := time.Now().Add(timeout)
+	for !l.Rooms.Allow("") {
+		if time.Now().After(deadline) {
+			limitCounters.Add("rooms", 1)
+			return false
+		}
+		time.Sleep(time.Second)
+	}
+	return true
+}
+
+// Rejects the creation of sessions from an IP address creating too many
+func (l *RateLimits) limitSessions(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("session_id"); err != nil && !l.Sessions.Allow(remoteIP(r)) {
+			limitCounters.Add("sessions", 1)
+			http.Error(w, "Too many sessions, try again later", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Reverse proxies whose X-Forwarded-For and X-Real-IP headers are believed.
+// Set it before starting the server, requests from anywhere else are
+// identified by their own address
+var TrustedProxies []*net.IPNet
+
+// Parses a list of IP addresses and CIDR ranges, separated by commas
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range TrustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// The visitor's IP address. Behind trusted proxies, it's the last address of
+// X-Forwarded-For not of a trusted proxy, as earlier ones are whatever the
+// client claimed, else X-Real-IP
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	hops := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		if !trustedProxy(hop) {
+			return hop
+		}
+		host = hop
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); len(hops) == 0 && net.ParseIP(real) != nil {
+		return real
+	}
+	return host
+}
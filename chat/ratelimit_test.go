@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.1, 192.168.0.0/16, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	TrustedProxies = proxies
+	defer func() { TrustedProxies = nil }()
+
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		realIP    string
+		want      string
+	}{
+		{"direct", "198.51.100.7:4000", nil, "", "198.51.100.7"},
+		{"untrusted peer's headers", "198.51.100.7:4000", []string{"203.0.113.5"}, "203.0.113.6", "198.51.100.7"},
+		{"trusted proxy", "10.0.0.1:4000", []string{"203.0.113.5"}, "", "203.0.113.5"},
+		{"trusted range", "192.168.4.2:4000", []string{"203.0.113.5"}, "", "203.0.113.5"},
+		{"trusted ipv6 proxy", "[::1]:4000", []string{"2001:db8::1"}, "", "2001:db8::1"},
+		{"spoofed first hop", "10.0.0.1:4000", []string{"1.2.3.4, 203.0.113.5"}, "", "203.0.113.5"},
+		{"proxy chain", "10.0.0.1:4000", []string{"203.0.113.5, 192.168.1.1"}, "", "203.0.113.5"},
+		{"repeated header", "10.0.0.1:4000", []string{"1.2.3.4", "203.0.113.5"}, "", "203.0.113.5"},
+		{"invalid hop", "10.0.0.1:4000", []string{"203.0.113.5, garbage"}, "", "10.0.0.1"},
+		{"all trusted", "10.0.0.1:4000", []string{"192.168.1.1"}, "", "192.168.1.1"},
+		{"real ip", "10.0.0.1:4000", nil, "203.0.113.5", "203.0.113.5"},
+		{"invalid real ip", "10.0.0.1:4000", nil, "garbage", "10.0.0.1"},
+		{"no headers", "10.0.0.1:4000", nil, "", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/session", nil)
+			r.RemoteAddr = test.peer
+			for _, header := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			if test.realIP != "" {
+				r.Header.Set("X-Real-IP", test.realIP)
+			}
+			if got := remoteIP(r); got != test.want {
+				t.Errorf("remoteIP = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if proxies, err := ParseTrustedProxies(""); err != nil || len(proxies) != 0 {
+		t.Errorf("empty list parsed as %v, %v", proxies, err)
+	}
+	for _, list := range []string{"10.0.0", "10.0.0.0/33", "proxy.example.org"} {
+		if _, err := ParseTrustedProxies(list); err == nil {
+			t.Errorf("%q parsed", list)
+		}
+	}
+}
+
+func TestLimitCountersServedByAdmin(t *testing.T) {
+	s := newTestServer(t)
+	limits := NewRateLimits(0, 1, 0, 5)
+	limits.check("visitor", &JSONMessage{Body: "far too long"})
+	limits.check("visitor", &JSONMessage{Body: "hi"})
+	limits.check("visitor", &JSONMessage{Body: "hi"})
+
+	admin := NewAdmin("token", s)
+	r := httptest.NewRequest("GET", "/admin/limits", nil)
+	w := httptest.NewRecorder()
+	admin.authorized(admin.serveLimits)(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("counters served without the token, %d", w.Code)
+	}
+	r.Header.Set("Authorization", "Bearer token")
+	w = httptest.NewRecorder()
+	admin.authorized(admin.serveLimits)(w, r)
+	var counts map[string]int64
+	if err := json.NewDecoder(w.Body).Decode(&counts); err != nil {
+		t.Fatal(err)
+	}
+	if counts["too_long"] < 1 || counts["messages"] < 1 {
+		t.Errorf("counts %v", counts)
+	}
+
+	// nothing about the process is published to visitors
+	_, pattern := http.DefaultServeMux.Handler(httptest.NewRequest("GET", "/debug/vars", nil))
+	if pattern == "/debug/vars" {
+		t.Error("/debug/vars served by the public listener")
+	}
+}
@@ -0,0 +1,170 @@
+package chat
+
+import (
+	"database/sql"
+	"log"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// Reaction of an agent, or of the visitor, to a message of the session
+type Reaction struct {
+	Id       int
+	Session  string
+	Seq      int // of the message reacted to
+	Author   string
+	Reaction string
+	EventID  string
+}
+
+func (r *Reaction) Create() error {
+	res, err := DB.GetDB().Exec("INSERT INTO Reaction (session, seq, author, reaction, event_id) VALUES (?, ?, ?, ?, ?)",
+		r.Session, r.Seq, r.Author, r.Reaction, r.EventID)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	r.Id = int(id)
+	return err
+}
+
+func (r *Reaction) Delete() error {
+	_, err := DB.GetDB().Exec("DELETE FROM Reaction WHERE id = ?", r.Id)
+	return err
+}
+
+func (r *Reaction) Frame(frameType string) *JSONMessage {
+	return &JSONMessage{Type: frameType, Ref: r.Seq, Author: r.Author, Body: r.Reaction}
+}
+
+// Every reaction of the session, oldest first
+func LoadReactions(sessid string) ([]*Reaction, error) {
+	rows, err := DB.GetDB().Query("SELECT id, seq, author, reaction, event_id FROM Reaction WHERE session = ? ORDER BY id", sessid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reactions := []*Reaction{}
+	for rows.Next() {
+		r := &Reaction{Session: sessid}
+		if err := rows.Scan(&r.Id, &r.Seq, &r.Author, &r.Reaction, &r.EventID); err != nil {
+			return nil, err
+		}
+		reactions = append(reactions, r)
+	}
+	return reactions, rows.Err()
+}
+
+// Finds the visitor's reaction to the message numbered seq, nil if they
+// didn't react with it
+func FindReaction(sessid string, seq int, reaction string) (*Reaction, error) {
+	return findReaction("session = ? AND seq = ? AND reaction = ? AND author != '0'", sessid, seq, reaction)
+}
+
+// Finds the reaction relayed as, or from, a Matrix event, nil if there's none
+func ReactionByEvent(eventID mid.EventID) (*Reaction, error) {
+	return findReaction("event_id = ?", eventID.String())
+}
+
+func findReaction(where string, args ...interface{}) (*Reaction, error) {
+	r := &Reaction{}
+	row := DB.GetDB().QueryRow("SELECT id, session, seq, author, reaction, event_id FROM Reaction WHERE "+where, args...)
+	err := row.Scan(&r.Id, &r.Session, &r.Seq, &r.Author, &r.Reaction, &r.EventID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Handles a react or unreact frame of the visitor, about an agent's message,
+// relayed to Matrix as an annotation or its redaction
+func (s *Server) receiveReaction(c *Client, msg JSONMessage) *JSONMessage {
+	sessid := *c.session.SessionId
+	target, err := MessageBySeq(sessid, msg.Ref)
+	if err != nil {
+		log.Println("Could not look up message:", err)
+		return nil
+	}
+	if target == nil || *target.Author != "0" || *target.EventID == "" || msg.Body == "" {
+		log.Printf("client %d cannot react to message %d", c.id, msg.Ref)
+		return nil
+	}
+	room, err := s.roomOfMessage(c, target)
+	if err != nil {
+		log.Println("Could not relay reaction:", err)
+		return nil
+	}
+	reaction, err := FindReaction(sessid, target.Seq, msg.Body)
+	if err != nil {
+		log.Println("Could not look up reaction:", err)
+		return nil
+	}
+
+	if msg.Type == FrameReact {
+		if reaction != nil {
+			return &JSONMessage{Type: FrameAck, ID: msg.ID, Ref: target.Seq}
+		}
+		eventID, err := s.Mautrix_client.SendReaction(room, mid.EventID(*target.EventID), msg.Body)
+		if err != nil {
+			return nil
+		}
+		reaction = &Reaction{Session: sessid, Seq: target.Seq, Author: msg.Author, Reaction: msg.Body, EventID: eventID.String()}
+		if err := reaction.Create(); err != nil {
+			log.Println("Could not store reaction:", err)
+		}
+	} else {
+		if reaction == nil {
+			return &JSONMessage{Type: FrameAck, ID: msg.ID, Ref: target.Seq}
+		}
+		s.Mautrix_client.RedactEvent(room, mid.EventID(reaction.EventID), "reaction taken back")
+		if err := reaction.Delete(); err != nil {
+			log.Println("Could not delete reaction:", err)
+		}
+	}
+	s.publish(&SessionEvent{Session: sessid, Exclude: c.id, Frame: reaction.Frame(msg.Type)})
+	return &JSONMessage{Type: FrameAck, ID: msg.ID, Ref: target.Seq}
+}
+
+// Relays an agent's reaction to a message of the session
+func (s *Server) routeReaction(sessid string, evt *mevent.Event) {
+	rel := evt.Content.AsReaction().RelatesTo
+	if rel.Type != mevent.RelAnnotation || rel.Key == "" {
+		return
+	}
+	// a new leader replays reactions already relayed
+	if seen, err := ReactionByEvent(evt.ID); err != nil || seen != nil {
+		return
+	}
+	target, err := MessageByEvent(rel.EventID)
+	if err != nil || target == nil || *target.Session != sessid {
+		return
+	}
+	reaction := &Reaction{Session: sessid, Seq: target.Seq, Author: "0", Reaction: rel.Key, EventID: evt.ID.String()}
+	if err := reaction.Create(); err != nil {
+		log.Println("Could not store reaction:", err)
+		return
+	}
+	s.publish(&SessionEvent{Session: sessid, Frame: reaction.Frame(FrameReact)})
+}
+
+// Relays the redaction of a reaction to the session's sockets. Returns false
+// if the redacted event isn't a reaction
+func (s *Server) routeUnreact(sessid string, redacts mid.EventID) bool {
+	reaction, err := ReactionByEvent(redacts)
+	if err != nil || reaction == nil {
+		return false
+	}
+	if reaction.Session != sessid {
+		return true
+	}
+	if err := reaction.Delete(); err != nil {
+		log.Println("Could not delete reaction:", err)
+		return true
+	}
+	s.publish(&SessionEvent{Session: sessid, Frame: reaction.Frame(FrameUnreact)})
+	return true
+}
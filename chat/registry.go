@@ -0,0 +1,341 @@
+package chat
+
+import (
+	"hash/fnv"
+	"log"
+	"sync"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+// Number of independently locked partitions of the registry. Sessions only
+// contend with those hashing to the same shard
+const registryShards = 32
+
+// One catalog for each client, to store all websockets and chat history. It
+// is safe for concurrent use
+type ClientIndex struct {
+	mutex     sync.Mutex
+	clients   map[int]*Client //Each of these are independent sockets for the same client
+	history   []*Message      //Preserve messages from same client, as sockets are removed
+	room      mid.RoomID
+	roomReady chan struct{} // closed once the session has a room, see ready
+	creating  bool          // a room is being created for the session
+	loaded    sync.Once
+}
+
+func NewClientIndex() *ClientIndex {
+	return &ClientIndex{
+		clients:   make(map[int]*Client),
+		history:   []*Message{},
+		roomReady: make(chan struct{}),
+	}
+}
+
+// Loads the session's history from the database, only the first call does
+// and any concurrent one waits for it to complete
+func (i *ClientIndex) load(sessid string) {
+	i.loaded.Do(func() {
+		history, err := LoadMessages(sessid)
+		if err != nil {
+			log.Println("Could not load message history:", err)
+			return
+		}
+		i.mutex.Lock()
+		i.history = append(history, i.history...)
+		i.mutex.Unlock()
+	})
+}
+
+// Snapshot of the sockets, safe to iterate without holding any lock
+func (i *ClientIndex) Clients() []*Client {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	clients := make([]*Client, 0, len(i.clients))
+	for _, c := range i.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (i *ClientIndex) Client(id int) *Client {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.clients[id]
+}
+
+func (i *ClientIndex) Len() int {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return len(i.clients)
+}
+
+// Snapshot of the history, oldest first
+func (i *ClientIndex) History() []*Message {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return append([]*Message{}, i.history...)
+}
+
+func (i *ClientIndex) Append(msg *Message) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.history = append(i.history, msg)
+}
+
+// Replaces the message of the history with the same sequence number by an
+// edited one, or drops it if it was deleted
+func (i *ClientIndex) Replace(msg *Message) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	history := []*Message{}
+	for _, old := range i.history {
+		if old.Seq != msg.Seq {
+			history = append(history, old)
+		} else if *msg.Body != "" {
+			history = append(history, msg)
+		}
+	}
+	i.history = history
+}
+
+// Drops every message created before the given TimeFormat timestamp
+func (i *ClientIndex) Purge(before string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	history := []*Message{}
+	for _, msg := range i.history {
+		if *msg.Created >= before {
+			history = append(history, msg)
+		}
+	}
+	i.history = history
+}
+
+func (i *ClientIndex) RoomID() mid.RoomID {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.room
+}
+
+// Closed once the session has a room
+func (i *ClientIndex) ready() <-chan struct{} {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.roomReady
+}
+
+// Forgets the session's room once its conversation is closed, the next one is
+// in a new room
+func (i *ClientIndex) resetRoom(room mid.RoomID) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.room == room {
+		i.room = ""
+		i.roomReady = make(chan struct{})
+	}
+}
+
+func (i *ClientIndex) setRoom(room mid.RoomID) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.room == "" && room != "" {
+		i.room = room
+		close(i.roomReady)
+	}
+}
+
+// Returns true if the caller should create the session's room. Only one
+// caller at a time gets to, until it calls doneCreating
+func (i *ClientIndex) startCreating() bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.room != "" || i.creating {
+		return false
+	}
+	i.creating = true
+	return true
+}
+
+func (i *ClientIndex) doneCreating() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.creating = false
+}
+
+type registryShard struct {
+	mutex    sync.RWMutex
+	sessions map[string]*ClientIndex
+}
+
+// Every session with open sockets, sharded by session ID, plus an index of the
+// rooms they're chatting in
+type Registry struct {
+	shards     [registryShards]*registryShard
+	roomsMutex sync.RWMutex
+	rooms      map[mid.RoomID]string
+}
+
+func NewRegistry() *Registry {
+	r := &Registry{rooms: make(map[mid.RoomID]string)}
+	for i := range r.shards {
+		r.shards[i] = &registryShard{sessions: make(map[string]*ClientIndex)}
+	}
+	return r
+}
+
+func (r *Registry) shard(sessid string) *registryShard {
+	h := fnv.New32a()
+	h.Write([]byte(sessid))
+	return r.shards[h.Sum32()%registryShards]
+}
+
+// Registers a client under its session, creating the index if it's the first
+// socket of that session. first tells whether it is
+func (r *Registry) Add(c *Client) (index *ClientIndex, first bool) {
+	sessid := *c.GetSessionId()
+	shard := r.shard(sessid)
+	shard.mutex.Lock()
+	index = shard.sessions[sessid]
+	if index == nil {
+		index = NewClientIndex()
+		shard.sessions[sessid] = index
+		first = true
+	}
+	index.mutex.Lock()
+	index.clients[c.id] = c
+	index.mutex.Unlock()
+	shard.mutex.Unlock()
+
+	if room := mid.RoomID(*c.GetRoomId()); room != "" {
+		r.SetRoom(room, sessid, index)
+	}
+	return index, first
+}
+
+// Unregisters a client, and its session's index once no socket is left. The
+// history is reloaded from the database if the visitor comes back. The index
+// is returned when c was the session's last socket, nil otherwise
+func (r *Registry) Del(c *Client) *ClientIndex {
+	sessid := *c.GetSessionId()
+	shard := r.shard(sessid)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	index := shard.sessions[sessid]
+	if index == nil {
+		return nil
+	}
+	index.mutex.Lock()
+	_, found := index.clients[c.id]
+	delete(index.clients, c.id)
+	empty := len(index.clients) == 0
+	index.mutex.Unlock()
+	if !empty {
+		return nil
+	}
+	delete(shard.sessions, sessid)
+	if !found {
+		return nil
+	}
+	return index
+}
+
+func (r *Registry) Get(sessid string) *ClientIndex {
+	shard := r.shard(sessid)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	return shard.sessions[sessid]
+}
+
+// Forgets a deleted session. Its index is kept, without history, as long as
+// sockets are still open
+func (r *Registry) Forget(sessid string) {
+	shard := r.shard(sessid)
+	shard.mutex.Lock()
+	if index := shard.sessions[sessid]; index != nil {
+		if index.Len() == 0 {
+			delete(shard.sessions, sessid)
+		} else {
+			index.mutex.Lock()
+			index.history = []*Message{}
+			index.mutex.Unlock()
+		}
+	}
+	shard.mutex.Unlock()
+
+	r.roomsMutex.Lock()
+	defer r.roomsMutex.Unlock()
+	for room, owner := range r.rooms {
+		if owner == sessid {
+			delete(r.rooms, room)
+		}
+	}
+}
+
+// Calls fn for every session, holding one shard's read lock at a time
+func (r *Registry) Range(fn func(sessid string, index *ClientIndex)) {
+	for _, shard := range r.shards {
+		shard.mutex.RLock()
+		for sessid, index := range shard.sessions {
+			fn(sessid, index)
+		}
+		shard.mutex.RUnlock()
+	}
+}
+
+// Number of sessions with at least one open socket
+func (r *Registry) Len() int {
+	total := 0
+	for _, shard := range r.shards {
+		shard.mutex.RLock()
+		total += len(shard.sessions)
+		shard.mutex.RUnlock()
+	}
+	return total
+}
+
+// Records which session a room belongs to. index may be nil if the session
+// has no open sockets
+func (r *Registry) SetRoom(room mid.RoomID, sessid string, index *ClientIndex) {
+	r.roomsMutex.Lock()
+	r.rooms[room] = sessid
+	r.roomsMutex.Unlock()
+	if index != nil {
+		index.setRoom(room)
+	}
+}
+
+// Forgets which session a room belonged to, once its conversation is closed
+func (r *Registry) Unroom(room mid.RoomID) {
+	r.roomsMutex.Lock()
+	defer r.roomsMutex.Unlock()
+	delete(r.rooms, room)
+}
+
+// Finds the session chatting in a room, and its index if any socket is open.
+// Rooms unknown to the registry are looked up in the Session table once, and
+// the answer is remembered, even when no session owns the room
+func (r *Registry) FindByRoom(room mid.RoomID) (string, *ClientIndex) {
+	r.roomsMutex.RLock()
+	sessid, ok := r.rooms[room]
+	r.roomsMutex.RUnlock()
+	if !ok {
+		var err error
+		sessid, err = SessionByRoom(room)
+		if err != nil {
+			log.Printf("Could not look up the session of %s: %s", room, err)
+			return "", nil
+		}
+		r.roomsMutex.Lock()
+		if owner, ok := r.rooms[room]; ok {
+			sessid = owner
+		} else {
+			r.rooms[room] = sessid
+		}
+		r.roomsMutex.Unlock()
+	}
+	if sessid == "" {
+		return "", nil
+	}
+	return sessid, r.Get(sessid)
+}
@@ -0,0 +1,289 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+// How long each class of visitor data is kept, in days. Zero keeps that class
+// forever. Sessions are considered inactive since their last message or since
+// their creation if they never sent one
+type RetentionPolicy struct {
+	IPDays      int
+	MessageDays int
+	SessionDays int
+	Interval    time.Duration
+	Redact      bool // also redact purged messages on Matrix
+	DryRun      bool // only report what would be purged
+}
+
+func (p *RetentionPolicy) Enabled() bool {
+	return p.IPDays > 0 || p.MessageDays > 0 || p.SessionDays > 0
+}
+
+// What a purge did, or would do when running in dry-run mode
+type RetentionReport struct {
+	DryRun   bool
+	IPs      int
+	Messages int
+	Commands int
+	Notes    int
+	Sessions int
+	Redacted int
+}
+
+func (r *RetentionReport) String() string {
+	verb := "purged"
+	if r.DryRun {
+		verb = "would purge"
+	}
+	return fmt.Sprintf("retention %s: %d ip addresses, %d message bodies, %d command bodies, %d note bodies, %d inactive sessions, %d matrix events redacted",
+		verb, r.IPs, r.Messages, r.Commands, r.Notes, r.Sessions, r.Redacted)
+}
+
+type Retention struct {
+	policy *RetentionPolicy
+	server *Server
+}
+
+func NewRetention(policy *RetentionPolicy, server *Server) *Retention {
+	return &Retention{policy, server}
+}
+
+// Runs the purge once per interval, until the process exits. It returns right
+// away if the policy keeps everything
+func (r *Retention) Run() {
+	if !r.policy.Enabled() {
+		return
+	}
+	interval := r.policy.Interval
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// only one instance purges
+		if r.server.Mautrix_client.IsLeader() {
+			report, err := r.Purge(time.Now())
+			if err != nil {
+				log.Println("Retention purge failed:", err)
+			} else {
+				log.Println(report.String())
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// Row of the Session table, as much as retention needs to know about it
+type retainedSession struct {
+	session  string
+	roomID   string
+	ip       string
+	created  time.Time
+	activity time.Time
+}
+
+func cutoff(now time.Time, days int) time.Time {
+	return now.Add(-time.Duration(days) * 24 * time.Hour)
+}
+
+func (r *Retention) Purge(now time.Time) (*RetentionReport, error) {
+	report := &RetentionReport{DryRun: r.policy.DryRun}
+	sessions, err := r.loadSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.policy.SessionDays > 0 {
+		before := cutoff(now, r.policy.SessionDays)
+		for sessid, sess := range sessions {
+			if !sess.activity.Before(before) {
+				continue
+			}
+			report.Redacted += r.redact("session = ?", sessid, sessions)
+			if !r.policy.DryRun {
+				if err := r.deleteSession(sessid); err != nil {
+					return nil, err
+				}
+				r.server.Forget(sessid)
+			}
+			delete(sessions, sessid)
+			report.Sessions++
+		}
+	}
+
+	if r.policy.IPDays > 0 {
+		before := cutoff(now, r.policy.IPDays)
+		for sessid, sess := range sessions {
+			if sess.ip == "" || !sess.created.Before(before) {
+				continue
+			}
+			if !r.policy.DryRun {
+				if _, err := DB.GetDB().Exec("UPDATE Session SET ip = '' WHERE session = ?", sessid); err != nil {
+					return nil, err
+				}
+			}
+			report.IPs++
+		}
+	}
+
+	if r.policy.MessageDays > 0 {
+		before := cutoff(now, r.policy.MessageDays).UTC().Format(TimeFormat)
+		report.Redacted += r.redact("created < ? AND body != ''", before, sessions)
+		if r.policy.DryRun {
+			row := DB.GetDB().QueryRow("SELECT COUNT(*) FROM Message WHERE created < ? AND body != ''", before)
+			if err := row.Scan(&report.Messages); err != nil {
+				return nil, err
+			}
+			row = DB.GetDB().QueryRow("SELECT COUNT(*) FROM Command WHERE created < ? AND body != ''", before)
+			if err := row.Scan(&report.Commands); err != nil {
+				return nil, err
+			}
+			row = DB.GetDB().QueryRow("SELECT COUNT(*) FROM Note WHERE created < ? AND body != ''", before)
+			if err := row.Scan(&report.Notes); err != nil {
+				return nil, err
+			}
+		} else {
+			// event_id stays, a new leader replaying the rooms' timelines
+			// must still see these events as relayed
+			res, err := DB.GetDB().Exec("UPDATE Message SET body = '', html = '' WHERE created < ? AND body != ''", before)
+			if err != nil {
+				return nil, err
+			}
+			purged, _ := res.RowsAffected()
+			report.Messages = int(purged)
+			r.server.PurgeHistory(before)
+			// agents' commands may name the visitor too, the rows stay so
+			// that a replayed command isn't run again
+			res, err = DB.GetDB().Exec("UPDATE Command SET body = '' WHERE created < ? AND body != ''", before)
+			if err != nil {
+				return nil, err
+			}
+			purged, _ = res.RowsAffected()
+			report.Commands = int(purged)
+			// as do notes, so that a replayed internal message isn't kept again
+			res, err = DB.GetDB().Exec("UPDATE Note SET body = '' WHERE created < ? AND body != ''", before)
+			if err != nil {
+				return nil, err
+			}
+			purged, _ = res.RowsAffected()
+			report.Notes = int(purged)
+		}
+	}
+
+	return report, nil
+}
+
+func (r *Retention) loadSessions() (map[string]*retainedSession, error) {
+	sessions := make(map[string]*retainedSession)
+	rows, err := DB.GetDB().Query("SELECT session, COALESCE(expirity, ''), COALESCE(ip, ''), COALESCE(RoomID, '') FROM Session")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var expirity string
+		sess := &retainedSession{}
+		if err := rows.Scan(&sess.session, &expirity, &sess.ip, &sess.roomID); err != nil {
+			return nil, err
+		}
+		created, err := sessionCreated(expirity)
+		if err != nil {
+			log.Printf("Session %s has an invalid expirity %q, skipping", sess.session, expirity)
+			continue
+		}
+		sess.created = created
+		sess.activity = created
+		sessions[sess.session] = sess
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = DB.GetDB().Query("SELECT session, MAX(created) FROM Message GROUP BY session")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sessid, last string
+		if err := rows.Scan(&sessid, &last); err != nil {
+			return nil, err
+		}
+		sess := sessions[sessid]
+		if sess == nil {
+			continue
+		}
+		if activity, err := time.Parse(TimeFormat, last); err == nil && activity.After(sess.activity) {
+			sess.activity = activity
+		}
+	}
+	return sessions, rows.Err()
+}
+
+// Redacts on Matrix the events of every message matching the where clause and
+// returns how many were, or would be, redacted
+func (r *Retention) redact(where string, arg interface{}, sessions map[string]*retainedSession) int {
+	if !r.policy.Redact {
+		return 0
+	}
+	rows, err := DB.GetDB().Query("SELECT session, event_id, COALESCE(room, '') FROM Message WHERE event_id != '' AND "+where, arg)
+	if err != nil {
+		log.Println("Could not list messages to redact:", err)
+		return 0
+	}
+	type event struct{ room, id string }
+	events := []event{}
+	for rows.Next() {
+		var sessid, eventID, room string
+		if err := rows.Scan(&sessid, &eventID, &room); err != nil {
+			continue
+		}
+		// messages of closed conversations stay in their own room
+		if room != "" {
+			events = append(events, event{room, eventID})
+		} else if sess := sessions[sessid]; sess != nil && sess.roomID != "" {
+			events = append(events, event{sess.roomID, eventID})
+		}
+	}
+	rows.Close()
+
+	if r.policy.DryRun {
+		return len(events)
+	}
+	redacted := 0
+	for _, evt := range events {
+		err := r.server.Mautrix_client.RedactEvent(mid.RoomID(evt.room), mid.EventID(evt.id), "retention policy")
+		if err == nil {
+			redacted++
+		}
+	}
+	return redacted
+}
+
+func (r *Retention) deleteSession(sessid string) error {
+	tx, err := DB.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM Message WHERE session = ?", sessid); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, table := range []string{"Reaction", "Page", "Note", "Command", "Conversation"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE session = ?", sessid); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM Session WHERE session = ?", sessid); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,269 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+const day = 24 * time.Hour
+
+// Stores a session created at the given time
+func newRetainedSession(t *testing.T, sessid, room string, created time.Time) {
+	t.Helper()
+	_, err := DB.GetDB().Exec("INSERT INTO Session (session, expirity, alias, email, ip, RoomID) VALUES (?, ?, ?, '', '192.0.2.1', ?)",
+		sessid, created.Add(sessionLifetime).Format(expirityFormat), "Ada_Lovelace", room)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Stores a message of the session created at the given time
+func newRetainedMessage(t *testing.T, sessid, body, eventID string, created time.Time) {
+	t.Helper()
+	author := "0"
+	msg := NewMessage(&author, &body)
+	*msg.Session = sessid
+	*msg.EventID = eventID
+	*msg.Created = created.UTC().Format(TimeFormat)
+	if err := msg.Create(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countRows(t *testing.T, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := DB.GetDB().QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// Runs test once purging and once in dry-run mode
+func forEachMode(t *testing.T, test func(t *testing.T, dryRun bool)) {
+	for _, dryRun := range []bool{false, true} {
+		name := "purge"
+		if dryRun {
+			name = "dry-run"
+		}
+		t.Run(name, func(t *testing.T) { test(t, dryRun) })
+	}
+}
+
+func TestRetentionPurgeSessions(t *testing.T) {
+	forEachMode(t, func(t *testing.T, dryRun bool) {
+		s := newTestServer(t)
+		now := time.Now()
+		newRetainedSession(t, "inactive", "", now.Add(-100*day))
+		newRetainedMessage(t, "inactive", "hello", "$inactive", now.Add(-90*day))
+		newRetainedSession(t, "active", "", now.Add(-100*day))
+		newRetainedMessage(t, "active", "hello", "$active", now.Add(-day))
+		newRetainedSession(t, "new", "", now.Add(-day))
+
+		policy := &RetentionPolicy{SessionDays: 30, DryRun: dryRun}
+		report, err := NewRetention(policy, s).Purge(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Sessions != 1 || report.Messages != 0 || report.IPs != 0 {
+			t.Errorf("report %s, want 1 session", report)
+		}
+
+		want := 0
+		if dryRun {
+			want = 1
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM Session WHERE session = 'inactive'"); n != want {
+			t.Errorf("%d inactive sessions left, want %d", n, want)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM Message WHERE session = 'inactive'"); n != want {
+			t.Errorf("%d messages of the inactive session left, want %d", n, want)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM Session WHERE session IN ('active', 'new')"); n != 2 {
+			t.Errorf("%d active sessions left, want 2", n)
+		}
+	})
+}
+
+func TestRetentionPurgeIPs(t *testing.T) {
+	forEachMode(t, func(t *testing.T, dryRun bool) {
+		s := newTestServer(t)
+		now := time.Now()
+		newRetainedSession(t, "old", "", now.Add(-100*day))
+		newRetainedSession(t, "new", "", now.Add(-day))
+
+		policy := &RetentionPolicy{IPDays: 30, DryRun: dryRun}
+		report, err := NewRetention(policy, s).Purge(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.IPs != 1 || report.Sessions != 0 || report.Messages != 0 {
+			t.Errorf("report %s, want 1 ip address", report)
+		}
+
+		want := 0
+		if dryRun {
+			want = 1
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM Session WHERE session = 'old' AND ip != ''"); n != want {
+			t.Errorf("%d old ip addresses left, want %d", n, want)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM Session WHERE session = 'new' AND ip != ''"); n != 1 {
+			t.Error("new ip address purged")
+		}
+	})
+}
+
+func TestRetentionPurgeMessages(t *testing.T) {
+	forEachMode(t, func(t *testing.T, dryRun bool) {
+		s := newTestServer(t)
+		now := time.Now()
+		newRetainedSession(t, "visitor", "", now.Add(-100*day))
+		newRetainedMessage(t, "visitor", "old", "$old", now.Add(-90*day))
+		newRetainedMessage(t, "visitor", "new", "$new", now.Add(-day))
+
+		policy := &RetentionPolicy{MessageDays: 30, DryRun: dryRun}
+		report, err := NewRetention(policy, s).Purge(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Messages != 1 || report.Sessions != 0 || report.IPs != 0 {
+			t.Errorf("report %s, want 1 message body", report)
+		}
+
+		want := ""
+		if dryRun {
+			want = "old"
+		}
+		if msg, err := MessageByEvent(mid.EventID("$old")); err != nil {
+			t.Fatal(err)
+		} else if *msg.Body != want {
+			t.Errorf("old body %q, want %q", *msg.Body, want)
+		}
+		if msg, err := MessageByEvent(mid.EventID("$new")); err != nil {
+			t.Fatal(err)
+		} else if *msg.Body != "new" {
+			t.Errorf("new body %q, want it kept", *msg.Body)
+		}
+		// replayed timelines don't bring purged messages back
+		if seen, err := MessageExists(mid.EventID("$old")); err != nil || !seen {
+			t.Errorf("purged event not known as relayed: %v, %v", seen, err)
+		}
+	})
+}
+
+func TestRetentionRedact(t *testing.T) {
+	forEachMode(t, func(t *testing.T, dryRun bool) {
+		s := newTestServer(t)
+		hs := newFakeHomeserver(t, s)
+		now := time.Now()
+		newRetainedSession(t, "visitor", "!room:example.org", now.Add(-100*day))
+		newRetainedMessage(t, "visitor", "old", "$old", now.Add(-90*day))
+		newRetainedMessage(t, "visitor", "new", "$new", now.Add(-day))
+
+		policy := &RetentionPolicy{MessageDays: 30, Redact: true, DryRun: dryRun}
+		report, err := NewRetention(policy, s).Purge(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Redacted != 1 {
+			t.Errorf("report %s, want 1 event redacted", report)
+		}
+
+		want := 1
+		if dryRun {
+			want = 0
+		}
+		if sent := hs.sent("/redact/"); len(sent) != want {
+			t.Errorf("sent %v, want %d redactions", sent, want)
+		}
+		if len(hs.sent("/redact/$new")) > 0 {
+			t.Error("recent event redacted")
+		}
+	})
+}
+
+func TestRetentionPurgeCommands(t *testing.T) {
+	forEachMode(t, func(t *testing.T, dryRun bool) {
+		s := newTestServer(t)
+		now := time.Now()
+		newRetainedSession(t, "visitor", "", now.Add(-100*day))
+		for _, command := range []struct {
+			eventID string
+			created time.Time
+		}{{"$old", now.Add(-90 * day)}, {"$new", now.Add(-day)}} {
+			_, err := DB.GetDB().Exec("INSERT INTO Command (event_id, session, sender, body, created) VALUES (?, 'visitor', '@agent:example.org', '!note owes us money', ?)",
+				command.eventID, command.created.UTC().Format(TimeFormat))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		policy := &RetentionPolicy{MessageDays: 30, DryRun: dryRun}
+		report, err := NewRetention(policy, s).Purge(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Commands != 1 {
+			t.Errorf("report %s, want 1 command body", report)
+		}
+
+		want := 0
+		if dryRun {
+			want = 1
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM Command WHERE event_id = '$old' AND body != ''"); n != want {
+			t.Errorf("%d old command bodies left, want %d", n, want)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM Command WHERE event_id = '$new' AND body != ''"); n != 1 {
+			t.Error("recent command body purged")
+		}
+		// purged commands are still known as run
+		if n := countRows(t, "SELECT COUNT(*) FROM Command"); n != 2 {
+			t.Errorf("%d commands left, want 2", n)
+		}
+	})
+}
+
+func TestRetentionPurgeNotes(t *testing.T) {
+	forEachMode(t, func(t *testing.T, dryRun bool) {
+		s := newTestServer(t)
+		now := time.Now()
+		newRetainedSession(t, "visitor", "", now.Add(-100*day))
+		for _, note := range []*Note{
+			{Session: "visitor", Author: "@agent:example.org", Body: "owes us money", EventID: "$old", Created: now.Add(-90 * day).UTC().Format(TimeFormat)},
+			{Session: "visitor", Author: "@agent:example.org", Body: "paid", EventID: "$new", Created: now.Add(-day).UTC().Format(TimeFormat)},
+		} {
+			if err := note.Create(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		policy := &RetentionPolicy{MessageDays: 30, DryRun: dryRun}
+		report, err := NewRetention(policy, s).Purge(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Notes != 1 {
+			t.Errorf("report %s, want 1 note body", report)
+		}
+
+		want := 2
+		if !dryRun {
+			want = 1
+		}
+		notes, err := LoadNotes("visitor")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(notes) != want || notes[len(notes)-1].Body != "paid" {
+			t.Errorf("notes %+v left, want %d", notes, want)
+		}
+		// purged notes are still known as kept
+		if seen, err := NoteExists("$old"); err != nil || !seen {
+			t.Errorf("the purged note's event is forgotten, %v", err)
+		}
+	})
+}
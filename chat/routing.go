@@ -0,0 +1,232 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// Strategies picking the agent a new conversation is offered to
+const (
+	RouteRoundRobin  = "round-robin"  // each agent in turn
+	RouteLeastActive = "least-active" // the agent with the fewest conversations not closed
+	RouteSkills      = "skills"       // the least active agent with a skill among the session's tags
+)
+
+// Agent conversations may be offered to
+type Agent struct {
+	ID     mid.UserID
+	Skills []string
+}
+
+// Parses agents separated by commas, each a Matrix ID optionally followed by
+// = and its skills separated by |, as in
+// "@alice:example.org=sales|billing,@bob:example.org"
+func ParseAgents(list string) ([]*Agent, error) {
+	agents := []*Agent{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		agent := &Agent{}
+		if i := strings.Index(entry, "="); i >= 0 {
+			for _, skill := range strings.Split(entry[i+1:], "|") {
+				if skill = strings.TrimSpace(skill); skill != "" {
+					agent.Skills = append(agent.Skills, strings.ToLower(skill))
+				}
+			}
+			entry = entry[:i]
+		}
+		agent.ID = mid.UserID(entry)
+		if _, _, err := agent.ID.Parse(); err != nil {
+			return nil, fmt.Errorf("%s is not a Matrix ID", entry)
+		}
+		agents = append(agents, agent)
+	}
+	return agents, nil
+}
+
+// Whether the agent has any of the skills
+func (a *Agent) hasSkill(tags []string) bool {
+	for _, tag := range tags {
+		for _, skill := range a.Skills {
+			if strings.EqualFold(tag, skill) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Pool of agents new conversations are offered to. An invited agent who
+// doesn't join the room within JoinTimeout is replaced by the next one picked
+type Routing struct {
+	mutex       sync.Mutex
+	agents      []*Agent
+	strategy    string
+	JoinTimeout time.Duration // zero never replaces an agent
+	next        int           // of round-robin
+}
+
+// An empty pool leaves every conversation to MATRIX_RECIPIENT. Unknown
+// strategies are round-robin
+func NewRouting(agents []*Agent, strategy string, joinTimeout time.Duration) *Routing {
+	switch strategy {
+	case RouteRoundRobin, RouteLeastActive, RouteSkills:
+	default:
+		if strategy != "" {
+			log.Printf("Unknown routing strategy %s, using %s", strategy, RouteRoundRobin)
+		}
+		strategy = RouteRoundRobin
+	}
+	return &Routing{
+		agents:      agents,
+		strategy:    strategy,
+		JoinTimeout: joinTimeout,
+	}
+}
+
+// Agents of the pool, in the configured order
+func (r *Routing) Agents() []*Agent {
+	if r == nil {
+		return nil
+	}
+	return r.agents
+}
+
+// Picks the agent to offer a conversation of a session with the tags to,
+// skipping those tried already. Agents offline on Matrix are only picked when
+// every other one is. Empty when there's nobody left to pick
+func (r *Routing) Pick(b *BotPlexer, tags []string, tried map[mid.UserID]bool) mid.UserID {
+	if r == nil {
+		return ""
+	}
+	candidates := []*Agent{}
+	for _, agent := range r.agents {
+		if !tried[agent.ID] {
+			candidates = append(candidates, agent)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	if r.strategy == RouteSkills && len(tags) > 0 {
+		skilled := []*Agent{}
+		for _, agent := range candidates {
+			if agent.hasSkill(tags) {
+				skilled = append(skilled, agent)
+			}
+		}
+		if len(skilled) > 0 {
+			candidates = skilled
+		}
+	}
+	online := []*Agent{}
+	for _, agent := range candidates {
+		if b.Presence(agent.ID) != mevent.PresenceOffline {
+			online = append(online, agent)
+		}
+	}
+	if len(online) > 0 {
+		candidates = online
+	}
+
+	if r.strategy == RouteRoundRobin {
+		return r.roundRobin(candidates)
+	}
+	return r.leastActive(candidates)
+}
+
+// The first candidate after the one last picked, in the pool's order
+func (r *Routing) roundRobin(candidates []*Agent) mid.UserID {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i := range r.agents {
+		n := (r.next + i) % len(r.agents)
+		for _, agent := range candidates {
+			if agent.ID == r.agents[n].ID {
+				r.next = n + 1
+				return agent.ID
+			}
+		}
+	}
+	return candidates[0].ID
+}
+
+// The candidate with the fewest conversations not closed, the first one of the
+// pool on a tie
+func (r *Routing) leastActive(candidates []*Agent) mid.UserID {
+	active, err := activeConversations()
+	if err != nil {
+		log.Println("Could not count conversations:", err)
+	}
+	best := candidates[0]
+	for _, agent := range candidates[1:] {
+		if active[agent.ID.String()] < active[best.ID.String()] {
+			best = agent
+		}
+	}
+	return best.ID
+}
+
+// Conversations not closed, by the agent they're offered or assigned to
+func activeConversations() (map[string]int, error) {
+	active := make(map[string]int)
+	rows, err := DB.GetDB().Query("SELECT agent, COUNT(*) FROM Conversation WHERE state != ? GROUP BY agent", StateClosed)
+	if err != nil {
+		return active, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var agent string
+		var count int
+		if err := rows.Scan(&agent, &count); err != nil {
+			return active, err
+		}
+		active[agent] = count
+	}
+	return active, rows.Err()
+}
+
+// Offers the conversation in the room to another agent while the one invited
+// doesn't join it within the join timeout, until one does, the conversation
+// is answered or closed, or every agent was tried
+func (s *Server) awaitAgent(sessid string, room mid.RoomID, agent mid.UserID) {
+	if s.routing == nil || s.routing.JoinTimeout <= 0 || agent == "" {
+		return
+	}
+	tried := map[mid.UserID]bool{agent: true}
+	for {
+		time.Sleep(s.routing.JoinTimeout)
+		for invited := range tried {
+			if joined, err := s.Mautrix_client.HasJoined(room, invited); err != nil || joined {
+				return
+			}
+		}
+		conv, err := ConversationByRoom(room)
+		if err != nil || conv == nil || conv.State != StateWaiting {
+			return
+		}
+		next := s.routing.Pick(s.Mautrix_client, SessionTags(sessid), tried)
+		if next == "" {
+			log.Printf("No agent joined %s in time", room)
+			return
+		}
+		tried[next] = true
+		if err := s.Mautrix_client.InviteUser(room, next); err != nil {
+			return
+		}
+		conv.Agent = next.String()
+		if err := conv.Save(); err != nil {
+			log.Println("Could not store conversation:", err)
+		}
+		s.Mautrix_client.SendNotice(room, fmt.Sprintf("%s did not join in time, %s was invited too", agent, next))
+		agent = next
+	}
+}
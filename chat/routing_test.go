@@ -0,0 +1,155 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+const (
+	alice = mid.UserID("@alice:example.org")
+	bob   = mid.UserID("@bob:example.org")
+	carol = mid.UserID("@carol:example.org")
+)
+
+func newTestRouting(t *testing.T, strategy string) *Routing {
+	t.Helper()
+	agents, err := ParseAgents("@alice:example.org=sales|Billing, @bob:example.org, @carol:example.org=support")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRouting(agents, strategy, 0)
+}
+
+// Tells the bot the agents' presence, as the sync would
+func setPresence(b *BotPlexer, state mevent.Presence, agents ...mid.UserID) {
+	for _, agent := range agents {
+		b.presences.set(agent, state, false)
+	}
+}
+
+func TestParseAgents(t *testing.T) {
+	agents, err := ParseAgents("@alice:example.org=sales|Billing, @bob:example.org,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 2 || agents[0].ID != alice || agents[1].ID != bob {
+		t.Fatalf("agents %+v", agents)
+	}
+	if len(agents[0].Skills) != 2 || agents[0].Skills[1] != "billing" || len(agents[1].Skills) != 0 {
+		t.Errorf("skills %v and %v", agents[0].Skills, agents[1].Skills)
+	}
+	if _, err := ParseAgents("alice=sales"); err == nil {
+		t.Error("parsed an agent without a Matrix ID")
+	}
+}
+
+func TestRoutingRoundRobin(t *testing.T) {
+	s := newTestServer(t)
+	setPresence(s.Mautrix_client, mevent.PresenceOnline, alice, bob, carol)
+	routing := newTestRouting(t, RouteRoundRobin)
+
+	picked := []mid.UserID{}
+	for i := 0; i < 4; i++ {
+		picked = append(picked, routing.Pick(s.Mautrix_client, nil, nil))
+	}
+	if picked[0] != alice || picked[1] != bob || picked[2] != carol || picked[3] != alice {
+		t.Errorf("picked %v, want each agent in turn", picked)
+	}
+
+	// offline agents are skipped while anybody else is online
+	setPresence(s.Mautrix_client, mevent.PresenceOffline, bob)
+	if agent := routing.Pick(s.Mautrix_client, nil, nil); agent != carol {
+		t.Errorf("picked %s after alice with bob offline, want carol", agent)
+	}
+	setPresence(s.Mautrix_client, mevent.PresenceOffline, alice, carol)
+	if agent := routing.Pick(s.Mautrix_client, nil, nil); agent == "" {
+		t.Error("nobody picked with everybody offline")
+	}
+
+	tried := map[mid.UserID]bool{alice: true, bob: true, carol: true}
+	if agent := routing.Pick(s.Mautrix_client, nil, tried); agent != "" {
+		t.Errorf("picked %s after everybody was tried", agent)
+	}
+}
+
+func TestRoutingLeastActive(t *testing.T) {
+	s := newTestServer(t)
+	setPresence(s.Mautrix_client, mevent.PresenceOnline, alice, bob, carol)
+	for _, conv := range []struct {
+		agent mid.UserID
+		state string
+	}{{alice, StateAssigned}, {alice, StateWaiting}, {bob, StateAssigned}, {carol, StateClosed}, {carol, StateClosed}} {
+		c := NewConversation("visitor")
+		c.Agent, c.State = conv.agent.String(), conv.state
+		if err := c.Create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	routing := newTestRouting(t, RouteLeastActive)
+	if agent := routing.Pick(s.Mautrix_client, nil, nil); agent != carol {
+		t.Errorf("picked %s, want carol whose conversations are closed", agent)
+	}
+	if agent := routing.Pick(s.Mautrix_client, nil, map[mid.UserID]bool{carol: true}); agent != bob {
+		t.Errorf("picked %s, want bob", agent)
+	}
+}
+
+func TestRoutingSkills(t *testing.T) {
+	s := newTestServer(t)
+	setPresence(s.Mautrix_client, mevent.PresenceOnline, alice, bob, carol)
+	routing := newTestRouting(t, RouteSkills)
+
+	tests := []struct {
+		tags []string
+		want mid.UserID
+	}{
+		{[]string{"support"}, carol},
+		{[]string{"BILLING"}, alice},
+		{[]string{"legal"}, alice}, // nobody has it, anybody will do
+		{nil, alice},
+	}
+	for _, test := range tests {
+		if agent := routing.Pick(s.Mautrix_client, test.tags, nil); agent != test.want {
+			t.Errorf("picked %s for %v, want %s", agent, test.tags, test.want)
+		}
+	}
+
+	// skills come first, presence only orders the skilled agents
+	setPresence(s.Mautrix_client, mevent.PresenceOffline, carol)
+	if agent := routing.Pick(s.Mautrix_client, []string{"support"}, nil); agent != carol {
+		t.Errorf("picked %s for support with carol offline, want carol still", agent)
+	}
+}
+
+func TestAwaitAgentInvitesNext(t *testing.T) {
+	s := newTestServer(t)
+	hs := newFakeHomeserver(t, s)
+	setPresence(s.Mautrix_client, mevent.PresenceOnline, alice, bob, carol)
+	s.routing = newTestRouting(t, RouteRoundRobin)
+	s.routing.JoinTimeout = 10 * time.Millisecond
+	s.routing.Pick(s.Mautrix_client, nil, nil) // alice was offered it
+	newTestSession(t, "visitor", "!room:example.org")
+	conv := NewConversation("visitor")
+	conv.Room, conv.State, conv.Agent = "!room:example.org", StateWaiting, alice.String()
+	if err := conv.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody ever joins the fake homeserver's rooms
+	s.awaitAgent("visitor", "!room:example.org", alice)
+
+	invites := hs.sent("/invite")
+	if len(invites) != 2 || !strings.Contains(invites[0], bob.String()) || !strings.Contains(invites[1], carol.String()) {
+		t.Errorf("invited %v, want bob then carol", invites)
+	}
+	if conv, err := CurrentConversation("visitor"); err != nil || conv.Agent != carol.String() {
+		t.Errorf("conversation offered to %+v, %v", conv, err)
+	}
+	if len(hs.sent("did not join in time")) != 2 {
+		t.Error("agents not told who was invited")
+	}
+}
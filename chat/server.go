@@ -1,118 +1,487 @@
 package chat
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
-	"golang.org/x/net/websocket"
-	"maunium.net/go/mautrix/format"
+	"github.com/gorilla/websocket"
+	mevent "maunium.net/go/mautrix/event"
 	mid "maunium.net/go/mautrix/id"
 )
 
-// One catalog for each client, to store all websockets and chat history
-type ClientIndex struct {
-	clients map[int]*Client //Each of these are independent sockets for the same client
-	history []*Message      //Preserve messages from same client, as sockets are removed
-}
-
-func NewClientIndex() *ClientIndex {
-	clients := make(map[int]*Client)
-	history := []*Message{}
-
-	return &ClientIndex{
-		clients,
-		history,
-	}
-}
+// How long a visitor's message waits for their room to be created before it
+// is given up on, and only kept in the history
+const roomWait = 30 * time.Second
 
 // Chat server.
 type Server struct {
 	encrypted      bool
 	pattern        string
-	messages       []*JSONMessage
-	clients        map[string]*ClientIndex
-	addCh          chan *Client
-	delCh          chan *Client
-	sendAllCh      chan *JSONMessage
+	heartbeat      *Heartbeat
+	limits         *ClientLimits
+	formatting     *Formatting
+	rates          *RateLimits
+	routing        *Routing
+	inbox          *OfflineInbox
+	hours          *BusinessHours
+	queue          *Queue
+	profiles       *Profiles
+	replies        *AutoReplies
+	notePrefix     string // of agents' messages kept as notes
+	upgrader       *websocket.Upgrader
+	registry       *Registry
+	pubsub         PubSub
+	commands       *Commands
+	online         *VisitorsOnline
+	status         *AgentStatus
 	doneCh         chan bool
-	errCh          chan error
 	Mautrix_client *BotPlexer
 }
 
-// Create new chat server.
-func NewServer(pattern string, encrypted bool, mautrix_client *BotPlexer) *Server {
-	messages := []*JSONMessage{}
-	clients := make(map[string]*ClientIndex)
-	addCh := make(chan *Client)
-	delCh := make(chan *Client)
-	sendAllCh := make(chan *JSONMessage)
+// Create new chat server. Session events go through pubsub, so that sockets of
+// the same session may be connected to different instances
+func NewServer(pattern string, encrypted bool, heartbeat *Heartbeat, limits *ClientLimits, formatting *Formatting, rates *RateLimits, routing *Routing, inbox *OfflineInbox, hours *BusinessHours, queue *Queue, profiles *Profiles, replies *AutoReplies, notePrefix string, pubsub PubSub, mautrix_client *BotPlexer) *Server {
+	registry := NewRegistry()
 	doneCh := make(chan bool)
-	errCh := make(chan error)
+	upgrader := &websocket.Upgrader{
+		EnableCompression: limits.Compression,
+		// the widget is embedded in other sites, any origin is welcome
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
 
-	return &Server{
+	s := &Server{
 		encrypted,
 		pattern,
-		messages,
-		clients,
-		addCh,
-		delCh,
-		sendAllCh,
+		heartbeat,
+		limits,
+		formatting,
+		rates,
+		routing,
+		inbox,
+		hours,
+		queue,
+		profiles,
+		replies,
+		notePrefix,
+		upgrader,
+		registry,
+		pubsub,
+		NewCommands(),
+		NewVisitorsOnline(),
+		NewAgentStatus(),
 		doneCh,
-		errCh,
 		mautrix_client,
 	}
+	profiles.prefix = pattern + "/avatar/"
+	s.registerCommands()
+	return s
+}
+
+// Registers a client, sends it the session's history and, off the caller's
+// goroutine, makes sure the session has a room
+func (s *Server) Add(c *Client) {
+	index, first := s.registry.Add(c)
+	index.load(*c.session.SessionId)
+	if first {
+		s.online.connected(s, *c.session.SessionId, index.RoomID())
+	}
+	s.sendPastMessages(c, index)
+	c.Write(s.statusFrame())
+	if !s.hours.Open(time.Now()) {
+		c.Write(&JSONMessage{Type: FrameAfterHours, Body: s.hours.Notice()})
+	}
+	log.Printf("Added new Client: %s, total sessions now: (%d)", *c.session.SessionId, s.registry.Len())
+	go s.setupRoom(c, index, false)
+}
+
+// Removes a client from the server, it may be called from any goroutine
+func (s *Server) Del(c *Client) {
+	if index := s.registry.Del(c); index != nil {
+		s.online.disconnected(s, *c.session.SessionId, index.RoomID())
+	}
+	log.Printf("Removed client %d, total sessions now: (%d)", c.id, s.registry.Len())
+}
+
+func (s *Server) Done() {
+	s.doneCh <- true
+}
+
+func (s *Server) Err(err error) {
+	log.Println("Error:", err.Error())
 }
 
-func (s *Server) FindClientByRoomID(roomid mid.RoomID) (Client, error) {
+// Drops a session, and its history, from memory on every instance. Used once
+// it's been deleted from the database
+func (s *Server) Forget(sessid string) {
+	s.publish(&SessionEvent{Session: sessid, Forget: true})
+}
+
+// Drops from memory, on every instance, each message created before the given
+// timestamp, which must be formatted as TimeFormat
+func (s *Server) PurgeHistory(before string) {
+	s.publish(&SessionEvent{Purge: before})
+}
+
+func (s *Server) publish(evt *SessionEvent) {
+	evt.Origin = InstanceID
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		log.Println("Could not encode session event:", err)
+		return
+	}
+	if err := s.pubsub.Publish(sessionTopic, payload); err != nil {
+		log.Println("Could not publish session event:", err)
+	}
+}
+
+// Applies a session event, published by any instance, to the sessions this
+// instance holds sockets of
+func (s *Server) deliver(payload []byte) {
+	var evt SessionEvent
+	if err := json.Unmarshal(payload, &evt); err != nil {
+		log.Println("Could not decode session event:", err)
+		return
+	}
+	if evt.Purge != "" {
+		s.registry.Range(func(_ string, index *ClientIndex) {
+			index.Purge(evt.Purge)
+		})
+	}
+	if evt.Session == "" {
+		if evt.Frame != nil {
+			// for every visitor
+			s.registry.Range(func(_ string, index *ClientIndex) {
+				for _, c := range index.Clients() {
+					c.Write(evt.Frame)
+				}
+			})
+		}
+		return
+	}
+	if evt.Forget {
+		s.registry.Forget(evt.Session)
+		return
+	}
+	index := s.registry.Get(evt.Session)
+	if evt.Room != "" {
+		s.registry.SetRoom(mid.RoomID(evt.Room), evt.Session, index)
+	}
+	if evt.Closed != "" {
+		s.registry.Unroom(mid.RoomID(evt.Closed))
+		if index != nil {
+			index.resetRoom(mid.RoomID(evt.Closed))
+		}
+	}
+	if index == nil {
+		return
+	}
+	if evt.Kick != "" {
+		for _, c := range index.Clients() {
+			c.Kick(ClosePolicyViolation, evt.Kick)
+		}
+		return
+	}
+	if evt.Message != nil {
+		index.Append(evt.Message)
+	}
+	if evt.Update != nil {
+		index.Replace(evt.Update)
+	}
+	if evt.Frame != nil {
+		for _, c := range index.Clients() {
+			if evt.Origin != InstanceID || c.id != evt.Exclude {
+				c.Write(evt.Frame)
+			}
+		}
+	}
+}
 
-	for _, client := range s.clients {
-		for _, client_id := range client.clients {
-			if c := client_id.GetRoomId(); mid.RoomID(*c) == roomid {
-				return *client_id, nil
+// Joins the session's room, or creates it if the session doesn't have one. At
+// most one room is created per session, however many sockets it opens. Once
+// the session's conversation was closed, a new room is only created when the
+// visitor writes again, which reopen tells
+func (s *Server) setupRoom(c *Client, index *ClientIndex, reopen bool) {
+	sessid := *c.session.SessionId
+	if rid := index.RoomID(); rid != "" {
+		s.Mautrix_client.JoinRoomByID(rid)
+		return
+	}
+	if !index.startCreating() {
+		return
+	}
+	defer index.doneCreating()
+	// another instance may have created it since the session was loaded
+	if rid, err := RoomBySession(sessid); err == nil && rid != "" {
+		s.publish(&SessionEvent{Session: sessid, Room: rid.String()})
+		return
+	}
+	// or be creating it, as may this one for an index since replaced
+	if claimed, err := ClaimRoom(sessid); err != nil || !claimed {
+		if err != nil {
+			log.Println("Could not claim room:", err)
+		}
+		return
+	}
+	defer ReleaseRoom(sessid)
+	if s.offlineMode() {
+		// the visitor's messages go to the offline inbox until an agent is online
+		return
+	}
+	conv, err := CurrentConversation(sessid)
+	if err != nil {
+		log.Println("Could not look up conversation:", err)
+		return
+	}
+	if conv == nil {
+		if !reopen {
+			if last, err := findConversation("session = ? ORDER BY id DESC", sessid); err != nil || last != nil {
+				return
 			}
 		}
+		conv = NewConversation(sessid)
+		if err := conv.Create(); err != nil {
+			log.Println("Could not store conversation:", err)
+			return
+		}
+	}
+	if s.queue.enabled() && conv.State == StateQueued {
+		// the leader dequeues it
+		s.enqueue(conv)
+		return
+	}
+	agent, ok := s.pickAgent(sessid)
+	if !ok || s.queueLength() > 0 {
+		s.enqueue(conv)
+		return
+	}
+	if _, err := s.openRoom(c.session, conv, agent); err != nil {
+		log.Printf("Could not open the room of %s: %s", sessid, err)
 	}
-	return Client{}, error(fmt.Errorf("No clients with such RoomID"))
 }
 
-func (s *Server) Add(c *Client) {
-	s.addCh <- c
+// Creates the room of a session's conversation and invites the agent to it,
+// MATRIX_RECIPIENT if empty
+func (s *Server) openRoom(session *Session, conv *Conversation, agent mid.UserID) (mid.RoomID, error) {
+	sessid := *session.SessionId
+	if !s.rates.waitRoom(roomWait) {
+		return "", fmt.Errorf("too many rooms created")
+	}
+	if agent == "" {
+		agent = s.Mautrix_client.Recipient()
+	}
+	roomid, err := s.Mautrix_client.CreateRoom(session, s.encrypted, agent)
+	if err != nil {
+		return "", err
+	}
+	if _, err := DB.GetDB().Exec("UPDATE Session SET RoomID = ? WHERE session = ?", roomid.String(), sessid); err != nil {
+		log.Println("Could not store room:", err)
+	}
+	conv.Room = roomid.String()
+	conv.State = StateWaiting
+	conv.Agent = agent.String()
+	if err := conv.Save(); err != nil {
+		log.Println("Could not store conversation:", err)
+	}
+	s.publish(&SessionEvent{Session: sessid, Room: roomid.String()})
+	if now := time.Now(); !s.hours.Open(now) {
+		s.Mautrix_client.SendNotice(roomid, s.hours.marker(now))
+	}
+	go s.awaitAgent(sessid, roomid, agent)
+	return roomid, nil
 }
 
-func (s *Server) Del(c *Client) {
-	s.delCh <- c
+func (s *Server) AppendNewMessage(client *Client, msg *Message) {
+	if err := s.appendMessage(*client.GetSessionId(), msg); err != nil {
+		log.Println("Could not store message:", err)
+	}
 }
 
-func (s *Server) SendAll(msg *JSONMessage) {
-	s.sendAllCh <- msg
+// Stores a message of the session, and adds it to the in memory history of the
+// instances holding its sockets. Otherwise it'll be loaded when the visitor
+// returns
+func (s *Server) appendMessage(sessid string, msg *Message) error {
+	*msg.Session = sessid
+	if err := msg.Create(); err != nil {
+		return err
+	}
+	s.publish(&SessionEvent{Session: sessid, Message: msg})
+	return nil
 }
 
-func (s *Server) Done() {
-	s.doneCh <- true
+// The room of the client's session, waiting for it to be created if needed
+func (s *Server) roomOf(c *Client) (mid.RoomID, error) {
+	if index := s.registry.Get(*c.session.SessionId); index != nil {
+		select {
+		case <-index.ready():
+		case <-time.After(roomWait):
+			return "", fmt.Errorf("session %s has no room yet", *c.session.SessionId)
+		}
+		return index.RoomID(), nil
+	}
+	// the visitor may be posting from a tab connected to another instance
+	room, err := RoomBySession(*c.session.SessionId)
+	if err != nil || room == "" {
+		return "", fmt.Errorf("session %s has no room", *c.session.SessionId)
+	}
+	return room, nil
 }
 
-func (s *Server) Err(err error) {
-	s.errCh <- err
+// The room a message was relayed to, the session's current one unless the
+// message's conversation was closed since
+func (s *Server) roomOfMessage(c *Client, m *Message) (mid.RoomID, error) {
+	if *m.Room != "" {
+		return mid.RoomID(*m.Room), nil
+	}
+	return s.roomOf(c)
 }
 
-func (s *Server) AppendNewMessage(client *Client, msg *Message) {
-	sessid := *client.GetSessionId()
-	s.clients[sessid].history = append(s.clients[sessid].history, msg)
+// Relays a visitor's message to their room, waiting for the room to be created
+// if it's the first message of the session. See BotPlexer.SendMessage for
+// txnID
+func (s *Server) SendMatrixMessage(c *Client, msg JSONMessage, txnID string) (mid.RoomID, mid.EventID, error) {
+	r, err := s.roomOf(c)
+	if err != nil {
+		return "", "", err
+	}
+	log.Printf("message: %s\n RoomID: %s ", msg.String(), r)
+	content := s.formatting.VisitorContent(msg.Body)
+	resp, err := s.Mautrix_client.SendMessage(r, &content, txnID)
+	if err != nil {
+		return "", "", err
+	}
+	return r, resp.EventID, nil
+}
+
+// Commands agents may run in the rooms, to register more of them
+func (s *Server) Commands() *Commands {
+	return s.commands
 }
 
-func (s *Server) SendMatrixMessage(c *Client, msg JSONMessage) {
-	var r mid.RoomID
-	r = mid.RoomID(*c.session.RoomID)
-	log.Printf("message: %s\n RoomID: %s ", msg.String(), *c.session.RoomID)
-	content := format.RenderMarkdown(msg.Body, true, true)
-	s.Mautrix_client.SendMessage(r, &content)
+// Handles a frame sent by the visitor, whatever transport it came through.
+// Chat messages are stored before anything else, and acknowledged with their
+// sequence number and Matrix event by the returned frame, unless rejected by
+// the rate limits, then an error frame is returned. A message the
+// session already sent with the same ID is only acknowledged again, and
+// relayed if that failed the first time
+func (s *Server) Receive(c *Client, msg JSONMessage) *JSONMessage {
+	switch msg.Type {
+	case FramePong, FramePing:
+		// heartbeats only refresh the read deadline
+		return nil
+	case FrameAck:
+		c.Ack(msg.Seq)
+		return nil
+	case FrameClose:
+		if err := s.CloseConversation(*c.session.SessionId, ClosedByVisitor); err != nil {
+			log.Println("Could not close conversation:", err)
+		}
+		return nil
+	}
+	// whatever the frame claims, "0" being agents
+	msg.Author = *c.session.Alias
+	if rejected := s.rates.check(*c.session.SessionId, &msg); rejected != nil {
+		return rejected
+	}
+	switch msg.Type {
+	case FrameEdit, FrameDelete:
+		return s.receiveEdit(c, msg)
+	case FrameReact, FrameUnreact:
+		return s.receiveReaction(c, msg)
+	case FrameContact:
+		return s.receiveContact(c, msg)
+	}
+	sessid := *c.session.SessionId
+	if msg.ID != "" && !ValidClientID(msg.ID) {
+		log.Printf("client %d sent an invalid message ID, ignoring it", c.id)
+		msg.ID = ""
+	}
+	// the visitor writes again after their conversation was closed, or while
+	// no agent is online
+	offline, queued := false, false
+	if index := s.registry.Get(sessid); index != nil && index.RoomID() == "" {
+		if offline = s.offlineMode(); !offline {
+			// queued messages are relayed once the room is created
+			if queued = s.queued(sessid); !queued {
+				go s.setupRoom(c, index, true)
+			}
+		}
+	}
+	fresh := false
+	message := s.previousMessage(sessid, msg.ID)
+	if message == nil {
+		message = NewMessage(&msg.Author, &msg.Body)
+		*message.ClientID = msg.ID
+		retried := false
+		if err := s.appendMessage(sessid, message); err != nil {
+			// a retry of the message may have been stored meanwhile
+			if prev := s.previousMessage(sessid, msg.ID); prev != nil {
+				message, retried = prev, true
+			} else {
+				log.Println("Could not store message:", err)
+			}
+		}
+		if !retried {
+			msg.Seq = message.Seq
+			//broadcasting to same client sockets, excluding self:
+			s.Broadcast(c, &msg, true)
+			fresh = message.Id != 0
+		}
+	}
+	if *message.EventID == "" && offline {
+		s.sendOffline(sessid, message)
+	} else if *message.EventID == "" && !queued {
+		if room, eventID, err := s.SendMatrixMessage(c, msg, message.TxnID()); err == nil {
+			if err := message.SetEventID(room, eventID); err != nil {
+				log.Println("Could not store message event:", err)
+			}
+		}
+	}
+	if fresh {
+		go s.autoReply(c, message, s.greets(sessid, message), !offline && !queued)
+	}
+	return &JSONMessage{Type: FrameAck, ID: msg.ID, Seq: message.Seq, EventID: *message.EventID}
 }
 
-func (s *Server) sendPastMessages(c *Client) {
+// The message of the session with the client ID, if it was already stored
+func (s *Server) previousMessage(sessid, clientID string) *Message {
+	if clientID == "" {
+		return nil
+	}
+	msg, err := FindMessage(sessid, clientID)
+	if err != nil {
+		log.Println("Could not look up message:", err)
+		return nil
+	}
+	return msg
+}
+
+// Writes the client the messages it doesn't have yet, the whole history unless
+// it resumed from a sequence number, and the reactions to them
+func (s *Server) sendPastMessages(c *Client, index *ClientIndex) {
 	log.Println("Sending old messages from session: ")
-	for _, msg := range s.clients[*c.session.SessionId].history {
-		c.Write(&JSONMessage{Author: *msg.Author, Body: *msg.Body})
+	sent := make(map[int]bool)
+	for _, msg := range index.History() {
+		if c.missing(msg) {
+			c.Write(msg.Frame())
+			sent[msg.Seq] = true
+		}
+	}
+	if len(sent) == 0 {
+		return
+	}
+	reactions, err := LoadReactions(*c.session.SessionId)
+	if err != nil {
+		log.Println("Could not load reactions:", err)
+		return
+	}
+	for _, reaction := range reactions {
+		if sent[reaction.Seq] {
+			c.Write(reaction.Frame(FrameReact))
+		}
 	}
 }
 
@@ -120,109 +489,209 @@ func (s *Server) sendPastMessages(c *Client) {
 // then it will include the client, for example it should not be set to true if
 // you want to broadcast a message from socket A, but not to self.
 func (s *Server) Broadcast(c *Client, message *JSONMessage, exclude_self bool) {
-	for _, client_id := range s.clients[*c.session.SessionId].clients {
-		if !exclude_self || client_id.id != c.id {
-			client_id.Write(message)
+	evt := &SessionEvent{Session: *c.session.SessionId, Frame: message}
+	if exclude_self {
+		evt.Exclude = c.id
+	}
+	s.publish(evt)
+}
+
+// Relays a Matrix event to the sockets of the session owning its room. When
+// the visitor is offline, the message is only stored, to be delivered on their
+// next connection
+func (s *Server) route(evt *mevent.Event) {
+	sessid, _ := s.registry.FindByRoom(evt.RoomID)
+	// Many matrix events are not relevant
+	if sessid == "" {
+		return
+	}
+	// a new leader resyncs from scratch, replaying events already relayed
+	if seen, err := MessageExists(evt.ID); err != nil || seen {
+		return
+	}
+	switch evt.Type {
+	case mevent.EventRedaction:
+		s.routeRedaction(sessid, evt)
+		return
+	case mevent.EventReaction:
+		s.routeReaction(sessid, evt)
+		return
+	}
+	content := evt.Content.AsMessage()
+	if rel := content.OptionalGetRelatesTo(); rel != nil && rel.Type == mevent.RelReplace {
+		s.routeEdit(sessid, evt, rel.EventID)
+		return
+	}
+	body, _ := evt.Content.Raw["body"].(string)
+	original := content.GetReplyTo()
+	if original != "" {
+		// the widget shows what's replied to, not the quote of it, and a
+		// reply may be a command or a note
+		body = mevent.TrimReplyFallbackText(body)
+	}
+	if strings.HasPrefix(body, commandPrefix) {
+		s.runCommand(sessid, evt, body)
+		return
+	}
+	if s.internal(content, body) {
+		s.routeNote(sessid, evt, body)
+		return
+	}
+	html := AgentHTML(content)
+	replyTo := 0
+	if original != "" {
+		if target, err := MessageByEvent(original); err == nil && target != nil && *target.Session == sessid {
+			replyTo = target.Seq
+		}
+	}
+	author := "0"
+	msg := NewMessage(&author, &body)
+	*msg.Session = sessid
+	*msg.EventID = evt.ID.String()
+	*msg.Room = evt.RoomID.String()
+	*msg.HTML = html
+	profile := s.profiles.Get(s.Mautrix_client, evt.Sender)
+	*msg.Name = profile.Name
+	*msg.Avatar = profile.Avatar
+	*msg.Sender = evt.Sender.String()
+	msg.ReplyTo = replyTo
+	if err := msg.Create(); err != nil {
+		log.Println("Could not store message:", err)
+	}
+	s.assignConversation(sessid, evt.Sender)
+	s.publish(&SessionEvent{Session: sessid, Frame: msg.Frame(), Message: msg})
+}
+
+// Loads the session the request's cookie belongs to, unless it's blocked
+func (s *Server) authenticate(r *http.Request) (*Session, error) {
+	tokenCookie, err := r.Cookie("session_id")
+	if err != nil {
+		return nil, err
+	}
+	session := NewSession(nil, nil)
+	if err := DB.GetByPk(session, tokenCookie.Value, "session"); err != nil {
+		return nil, err
+	}
+	for _, ip := range []string{remoteIP(r), *session.IpAddr} {
+		if blocked, err := IsBlocked(ip, *session.SessionId, *session.Email); err != nil {
+			return nil, err
+		} else if blocked {
+			return nil, errBlocked
 		}
 	}
+	return session, nil
+}
+
+// Records the page of the visitor's site a socket is opened from, given by the
+// widget or else by the browser
+func (s *Server) recordPage(session *Session, r *http.Request) {
+	page := r.URL.Query().Get("page")
+	if page == "" {
+		page = r.Referer()
+	}
+	if err := RecordPage(*session.SessionId, page); err != nil {
+		log.Println("Could not record page:", err)
+	}
 }
 
-func (s *Server) sendAll(msg *JSONMessage) {
-	for _, c := range s.clients {
-		for _, c := range c.clients {
-			c.Write(msg)
+// Answers the creation, or renewal, of a session with whether agents are
+// online and at work, so the widget may offer to leave a message instead
+func (s *Server) sessionStatus(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status != 0 {
+			// rejected
+			return
 		}
+		status := map[string]interface{}{"agents_online": s.AgentsOnline(), "open": true}
+		if !s.hours.Open(time.Now()) {
+			status["open"] = false
+			status["after_hours_message"] = s.hours.Message
+			status["response_time"] = s.hours.ResponseTime
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+}
+
+// Remembers whether the handler it's given to answered already
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
 	}
+	return w.ResponseWriter.Write(b)
 }
 
 // Trying to access the original request before it upgrades the http connection
 // to a websocket one. Use this to apply any middlewares, as for authentication
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	tokenCookie, err := r.Cookie("session_id")
+	session, err := s.authenticate(r)
 	if err != nil {
-		log.Panic("No session cookie, abort!")
+		authError(w, err)
+		return
 	}
 
-	// websocket handler
-	onConnected := func(ws *websocket.Conn) {
-		defer func() {
-			err := ws.Close()
-			if err != nil {
-				s.errCh <- err
-			}
-		}()
-
-		err, client := NewClient(ws, s, tokenCookie)
-		if err != nil {
-			err := ws.Close()
-			if err != nil {
-				s.errCh <- err
-			}
-		} else {
-			s.Add(client)
-			client.Listen()
-		}
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied with an error
+		log.Println("Could not upgrade to websocket:", err)
+		return
+	}
+	s.recordPage(session, r)
+	client := NewClient(newWSTransport(ws, s.limits), r.Context(), s, session)
+	if seq, ok := lastSeen(r); ok {
+		client.Ack(seq)
+	}
+	s.Add(client)
+	client.Listen()
+}
 
+// Closes every client of this instance, telling them the server is going
+// away so they reconnect, possibly to another instance
+func (s *Server) Shutdown() {
+	clients := []*Client{}
+	s.registry.Range(func(_ string, index *ClientIndex) {
+		clients = append(clients, index.Clients()...)
+	})
+	for _, c := range clients {
+		c.Kick(CloseGoingAway, "server shutting down")
 	}
-	handler := websocket.Handler(onConnected)
-	handler.ServeHTTP(w, r)
 }
 
 // Listen and serve.
-// It serves client connection and broadcast request.
+// It routes Matrix events to the sessions' sockets, which add and remove
+// themselves from the registry concurrently.
 func (s *Server) Listen() {
+	if err := s.pubsub.Subscribe(sessionTopic, s.deliver); err != nil {
+		log.Fatal("Could not subscribe to session events: ", err)
+	}
+	s.Mautrix_client.OnPresence(s.presenceChanged)
 	session := NewSession(nil, nil)
-	http.Handle("/session", session)
+	http.Handle("/session", s.rates.limitSessions(s.sessionStatus(session)))
 	http.Handle(s.pattern, s)
+	http.HandleFunc(s.pattern+"/events", s.serveEvents)
+	http.HandleFunc(s.pattern+"/poll", s.servePoll)
+	http.HandleFunc(s.pattern+"/send", s.serveSend)
+	http.HandleFunc(s.pattern+"/avatar/", s.serveAvatar)
+	http.HandleFunc(s.pattern+"/transcript", s.serveTranscript)
 
 	for {
 		select {
 
-		// Add new a client
-		case c := <-s.addCh:
-			if nclient := s.clients[*c.session.SessionId]; nclient == nil {
-				s.clients[*c.session.SessionId] = NewClientIndex()
-			}
-			s.sendPastMessages(c)
-			s.clients[*c.session.SessionId].clients[c.id] = c
-			log.Printf("Added new Client: %s, total clients now: (%d)", *c.session.SessionId, len(s.clients))
-			if rid := c.GetRoomId(); *rid != "" {
-				s.Mautrix_client.JoinRoomByID(mid.RoomID(*rid))
-			} else {
-				roomid, err := s.Mautrix_client.CreateRoom(c, s.encrypted)
-				if err != nil {
-					log.Println("Could not create room, abort!")
-				} else {
-					*c.session.RoomID = string(roomid)
-					DB.UpdateRow(c.session)
-				}
-			}
-
-		// del a client
-		case c := <-s.delCh:
-			if len(s.clients[*c.session.SessionId].clients) == 0 {
-				delete(s.clients, *c.session.SessionId)
-			} else {
-				delete(s.clients[*c.session.SessionId].clients, c.id)
-			}
-
-		// broadcast message for all clients
-		case msg := <-s.sendAllCh:
-			s.messages = append(s.messages, msg)
-			//s.sendAll(msg)
-
 		// listens to matrix events
 		case matrix_evt := <-s.Mautrix_client.Ch:
-			client, err := s.FindClientByRoomID(matrix_evt.RoomID)
-			// Many matrix events are not relevant
-			if err == nil {
-				jsonmsg := NewJSONMessage(matrix_evt.Content.Raw["body"].(string), "0")
-				client.server.Broadcast(&client, jsonmsg, false)
-				client.server.clients[*client.session.SessionId].history = append(client.server.clients[*client.session.SessionId].history, NewMessage(&jsonmsg.Author, &jsonmsg.Body))
-			}
-
-		case err := <-s.errCh:
-			log.Println("Error:", err.Error())
+			s.route(matrix_evt)
 
 		case <-s.doneCh:
 			return
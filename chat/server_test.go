@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSetupRoomCreatesOneRoom(t *testing.T) {
+	s := newTestServer(t)
+	hs := newFakeHomeserver(t, s)
+	newTestSession(t, "visitor", "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session := NewSession(nil, nil)
+			if err := DB.GetByPk(session, "visitor", "session"); err != nil {
+				t.Error(err)
+				return
+			}
+			// a fresh index each, as after the last socket closed or on
+			// another instance
+			c := NewClient(newFakeTransport(), context.Background(), s, session)
+			s.setupRoom(c, NewClientIndex(), false)
+		}()
+	}
+	wg.Wait()
+
+	if created := hs.sent("/createRoom"); len(created) != 1 {
+		t.Errorf("%d rooms created, want 1", len(created))
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM Conversation WHERE session = 'visitor'"); n != 1 {
+		t.Errorf("%d conversations, want 1", n)
+	}
+	if room, err := RoomBySession("visitor"); err != nil || room != "!fake:example.org" {
+		t.Errorf("session's room %q, %v", room, err)
+	}
+	// with the room stored, nobody may create another
+	if claimed, err := ClaimRoom("visitor"); err != nil || claimed {
+		t.Errorf("claimed the creation of an existing room: %v, %v", claimed, err)
+	}
+}
+
+func TestReceiveSetsVisitorAuthor(t *testing.T) {
+	s := newTestServer(t)
+	hs := newFakeHomeserver(t, s)
+	session := newTestSession(t, "visitor", "!room:example.org")
+	c := NewClient(newFakeTransport(), context.Background(), s, session)
+	s.Add(c)
+	defer c.Close()
+
+	// a visitor posing as an agent
+	ack := s.Receive(c, JSONMessage{ID: "client-1", Author: "0", Body: "I am the agent"})
+	if ack == nil || ack.Type != FrameAck {
+		t.Fatalf("answered %+v", ack)
+	}
+	msg, err := FindMessage("visitor", "client-1")
+	if err != nil || msg == nil {
+		t.Fatalf("message not stored: %v", err)
+	}
+	if *msg.Author != "Ada_Lovelace" {
+		t.Errorf("stored as written by %q, want the visitor", *msg.Author)
+	}
+	if len(hs.sent("I am the agent")) == 0 {
+		t.Error("message not relayed to the room")
+	}
+	text, err := Transcript("visitor", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "Ada Lovelace: I am the agent") {
+		t.Errorf("transcript %q doesn't attribute the message to the visitor", text)
+	}
+}
@@ -2,6 +2,7 @@ package chat
 
 import (
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"log"
 	"math/rand"
@@ -11,8 +12,15 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	mid "maunium.net/go/mautrix/id"
 )
 
+// Cookies, and therefore sessions, are valid for a year after their creation
+const sessionLifetime = 365 * 24 * time.Hour
+
+const expirityFormat = "2006-01-02 15:04:05 -0700"
+
 type Session struct {
 	Id        int     `db:"id"`
 	SessionId *string `db:"session"`
@@ -77,13 +85,12 @@ func (e *Session) GetSessionID() *string {
 //
 func (s *Session) createCookie(name, domain string) *http.Cookie {
 	m := regexp.MustCompile(`\.?([^.]*.[a-z]{0,4})$`)
-	format := "2006-01-02 15:04:05 -0700"
 	if len(m.FindStringSubmatch(domain)) > 1 {
 		domain = "." + m.FindStringSubmatch(domain)[1]
 	}
-	*s.Expirity = time.Now().Add(365 * 24 * time.Hour).Format(format)
+	*s.Expirity = time.Now().Add(sessionLifetime).Format(expirityFormat)
 	*s.SessionId = Hash254(strconv.Itoa(rand.Intn(128000)) + *s.Expirity)
-	time, _ := time.Parse(format, *s.Expirity)
+	time, _ := time.Parse(expirityFormat, *s.Expirity)
 	return &http.Cookie{
 		Value:   *s.SessionId,
 		Name:    "session_id",
@@ -102,21 +109,161 @@ func (s *Session) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	tokenCookie, err := r.Cookie("session_id")
+	sessid := ""
+	if err == nil {
+		sessid = tokenCookie.Value
+	}
+	if blocked, err := IsBlocked(remoteIP(r), sessid, r.PostForm.Get("email")); err != nil {
+		http.Error(w, "Could not check the blocklist", http.StatusInternalServerError)
+		return
+	} else if blocked {
+		authError(w, errBlocked)
+		return
+	}
 	if err != nil {
 		name := r.PostForm.Get("name")
 		surname := r.PostForm.Get("surname")
-		*s.IpAddr = r.RemoteAddr[:strings.LastIndex(r.RemoteAddr, ":")]
+		*s.IpAddr = remoteIP(r)
 		*s.Email = r.PostForm.Get("email")
 		*s.Alias = name + "_" + surname
 		cookie := s.createCookie("session_id", r.Host)
 		http.SetCookie(w, cookie)
 		*s.SessionId = cookie.Value
 		DB.InsertRow(s)
+		if err := SetSessionTags(*s.SessionId, r.PostForm.Get("tags")); err != nil {
+			log.Println("Could not store session tags:", err)
+		}
 	} else {
 		log.Println(tokenCookie.Value)
 	}
 }
 
+// Returns the ID of the session chatting in a room, or an empty string if the
+// room doesn't belong to any session
+func SessionByRoom(room mid.RoomID) (string, error) {
+	var sessid string
+	row := DB.GetDB().QueryRow("SELECT session FROM Session WHERE RoomID = ?", room.String())
+	if err := row.Scan(&sessid); err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	return sessid, nil
+}
+
+// Returns the room of a session, empty if it has none yet
+func RoomBySession(sessid string) (mid.RoomID, error) {
+	var room sql.NullString
+	row := DB.GetDB().QueryRow("SELECT RoomID FROM Session WHERE session = ?", sessid)
+	if err := row.Scan(&room); err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	return mid.RoomID(room.String), nil
+}
+
+// How long a room claim holds, in case its instance dies while creating it
+const roomClaimTTL = 2 * time.Minute
+
+// Claims the creation of a session's room, so that only one goroutine of one
+// instance creates it. False if the session has a room already or its
+// creation is claimed by someone else
+func ClaimRoom(sessid string) (bool, error) {
+	now := time.Now().UTC()
+	res, err := DB.GetDB().Exec("UPDATE Session SET room_claim = ? WHERE session = ? AND (RoomID IS NULL OR RoomID = '') AND (room_claim IS NULL OR room_claim < ?)",
+		now.Add(roomClaimTTL).Format(TimeFormat), sessid, now.Format(TimeFormat))
+	if err != nil {
+		return false, err
+	}
+	claimed, err := res.RowsAffected()
+	return claimed == 1, err
+}
+
+func ReleaseRoom(sessid string) {
+	if _, err := DB.GetDB().Exec("UPDATE Session SET room_claim = '' WHERE session = ?", sessid); err != nil {
+		log.Println("Could not release room claim:", err)
+	}
+}
+
+// Records the tags the pre-chat form gave, separated by commas, which the
+// skills routing strategy matches against agents' skills
+func SetSessionTags(sessid, tags string) error {
+	clean := []string{}
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+			clean = append(clean, tag)
+		}
+	}
+	if len(clean) == 0 {
+		return nil
+	}
+	joined := strings.Join(clean, ",")
+	if len(joined) > 256 {
+		joined = joined[:256]
+	}
+	_, err := DB.GetDB().Exec("UPDATE Session SET tags = ? WHERE session = ?", joined, sessid)
+	return err
+}
+
+// Tags of the session, none if it has none or they can't be read
+func SessionTags(sessid string) []string {
+	var tags sql.NullString
+	row := DB.GetDB().QueryRow("SELECT tags FROM Session WHERE session = ?", sessid)
+	if err := row.Scan(&tags); err != nil || tags.String == "" {
+		return nil
+	}
+	return strings.Split(tags.String, ",")
+}
+
+// Longest page address recorded
+const maxPageLength = 1024
+
+// Records the page of the visitor's site a socket was opened from, unless it
+// was the last one recorded
+func RecordPage(sessid, page string) error {
+	if page == "" {
+		return nil
+	}
+	if len(page) > maxPageLength {
+		page = page[:maxPageLength]
+	}
+	var last string
+	row := DB.GetDB().QueryRow("SELECT url FROM Page WHERE session = ? ORDER BY id DESC LIMIT 1", sessid)
+	if err := row.Scan(&last); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if last == page {
+		return nil
+	}
+	_, err := DB.GetDB().Exec("INSERT INTO Page (session, url, created) VALUES (?, ?, ?)",
+		sessid, page, time.Now().UTC().Format(TimeFormat))
+	return err
+}
+
+// The last pages the visitor chatted from, most recent first
+func LoadPages(sessid string, limit int) ([]string, error) {
+	rows, err := DB.GetDB().Query("SELECT url FROM Page WHERE session = ? ORDER BY id DESC LIMIT ?", sessid, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pages := []string{}
+	for rows.Next() {
+		var page string
+		if err := rows.Scan(&page); err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+	}
+	return pages, rows.Err()
+}
+
+// Sessions don't keep their creation date, it is derived from their expirity
+func sessionCreated(expirity string) (time.Time, error) {
+	expires, err := time.Parse(expirityFormat, expirity)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return expires.Add(-sessionLifetime), nil
+}
+
 func Hash254(args ...string) string {
 	hash := sha256.New()
 	for _, arg := range args {
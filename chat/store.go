@@ -3,7 +3,9 @@ package chat
 import (
 	"database/sql"
 	"log"
+	"strings"
 
+	"github.com/go-sql-driver/mysql"
 	"maunium.net/go/mautrix"
 )
 
@@ -31,7 +33,99 @@ func (store *StateStore) CreateTables() error {
 			  	alias varchar(100) DEFAULT NULL,
 			  	email varchar(100) DEFAULT NULL,
 			  	ip varchar(100) DEFAULT NULL,
-			  	RoomID varchar(256) DEFAULT NULL
+			  	RoomID varchar(256) DEFAULT NULL,
+			  	tags varchar(256) DEFAULT '',
+			  	room_claim varchar(100) DEFAULT ''
+			  )
+		`,
+		`CREATE TABLE if not exists Message(
+				id INTEGER PRIMARY KEY ,
+			  	session varchar(100) NOT NULL,
+			  	author varchar(100) DEFAULT NULL,
+			  	body TEXT DEFAULT NULL,
+			  	html TEXT DEFAULT NULL,
+			  	event_id varchar(256) DEFAULT NULL,
+			  	room varchar(256) DEFAULT NULL,
+			  	client_id varchar(100) DEFAULT NULL,
+			  	reply_to INTEGER DEFAULT 0,
+			  	name varchar(256) DEFAULT NULL,
+			  	avatar varchar(512) DEFAULT NULL,
+			  	auto INTEGER DEFAULT 0,
+			  	sender varchar(256) DEFAULT '',
+			  	created varchar(100) DEFAULT NULL,
+			  	seq INTEGER DEFAULT 0
+			  )
+		`,
+		`CREATE TABLE if not exists Reaction(
+				id INTEGER PRIMARY KEY ,
+				session varchar(100) NOT NULL,
+				seq INTEGER NOT NULL,
+				author varchar(100) DEFAULT NULL,
+				reaction varchar(100) NOT NULL,
+				event_id varchar(256) DEFAULT NULL
+			  )
+		`,
+		`CREATE TABLE if not exists Block(
+				id INTEGER PRIMARY KEY ,
+				kind varchar(20) NOT NULL,
+				value varchar(256) NOT NULL,
+				reason varchar(256) DEFAULT NULL,
+				author varchar(256) DEFAULT NULL,
+				created varchar(100) DEFAULT NULL
+			  )
+		`,
+		`CREATE TABLE if not exists Page(
+				id INTEGER PRIMARY KEY ,
+				session varchar(100) NOT NULL,
+				url varchar(1024) NOT NULL,
+				created varchar(100) DEFAULT NULL
+			  )
+		`,
+		`CREATE TABLE if not exists Note(
+				id INTEGER PRIMARY KEY ,
+				session varchar(100) NOT NULL,
+				conversation INTEGER DEFAULT 0,
+				author varchar(256) DEFAULT NULL,
+				body TEXT DEFAULT NULL,
+				event_id varchar(256) DEFAULT '',
+				created varchar(100) DEFAULT NULL
+			  )
+		`,
+		`CREATE TABLE if not exists Command(
+				event_id varchar(256) NOT NULL,
+				session varchar(100) NOT NULL,
+				sender varchar(256) DEFAULT NULL,
+				body TEXT DEFAULT NULL,
+				created varchar(100) DEFAULT NULL,
+				PRIMARY KEY (event_id)
+			  )
+		`,
+		`CREATE TABLE if not exists Conversation(
+				id INTEGER PRIMARY KEY ,
+				session varchar(100) NOT NULL,
+				room varchar(256) DEFAULT '',
+				state varchar(20) NOT NULL,
+				agent varchar(256) DEFAULT '',
+				opened varchar(100) DEFAULT '',
+				closed varchar(100) DEFAULT '',
+				closed_by varchar(20) DEFAULT ''
+			  )
+		`,
+		`CREATE TABLE if not exists Avatar(
+				path varchar(512) NOT NULL PRIMARY KEY
+			  )
+		`,
+		`CREATE TABLE if not exists Canned(
+				name varchar(100) PRIMARY KEY,
+				body TEXT NOT NULL,
+				updated varchar(100) DEFAULT ''
+			  )
+		`,
+		`CREATE TABLE if not exists Leader(
+				name varchar(100) NOT NULL,
+				holder varchar(100) DEFAULT NULL,
+				expires varchar(100) DEFAULT NULL,
+				PRIMARY KEY (name)
 			  )
 		`,
 		`
@@ -69,16 +163,77 @@ func (store *StateStore) CreateTables() error {
 		`,
 	}
 
+	// SQLite numbers INTEGER PRIMARY KEY columns on its own, MySQL only when
+	// told to
+	_, isMySQL := store.DB.Driver().(*mysql.MySQLDriver)
 	for _, query := range queries {
+		if isMySQL {
+			query = strings.Replace(query, "id INTEGER PRIMARY KEY", "id INTEGER PRIMARY KEY AUTO_INCREMENT", 1)
+		}
 		if _, err := tx.Exec(query); err != nil {
 			_ = tx.Rollback()
 			return err
 		}
 	}
 
+	indexes := []struct {
+		name, table, columns string
+		unique               bool
+	}{
+		{"message_client_id", "Message", "session, client_id", true},
+		{"message_seq", "Message", "session, seq", true},
+		{"message_session_created", "Message", "session, created", false},
+		{"block_kind_value", "Block", "kind, value", false},
+		{"conversation_session", "Conversation", "session, state", false},
+	}
+	for _, index := range indexes {
+		if err := createIndex(tx, isMySQL, index.name, index.table, index.columns, index.unique); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
 	if err = tx.Commit(); err != nil {
 		return err
 	}
 
+	// columns added to the tables since they were first created. Adding one
+	// fails harmlessly when it already exists
+	migrations := []string{
+		`ALTER TABLE Session ADD COLUMN tags varchar(256) DEFAULT ''`,
+		`ALTER TABLE Session ADD COLUMN room_claim varchar(100) DEFAULT ''`,
+	}
+	if isMySQL {
+		// created before it was numbered by MySQL
+		migrations = append(migrations, "ALTER TABLE Session MODIFY id INTEGER NOT NULL AUTO_INCREMENT")
+	}
+	for _, query := range migrations {
+		store.DB.Exec(query)
+	}
+
 	return nil
 }
+
+// Creates the index unless it already exists, neither database having a
+// portable way of saying so
+func createIndex(tx *sql.Tx, isMySQL bool, name, table, columns string, unique bool) error {
+	var count int
+	var row *sql.Row
+	if isMySQL {
+		row = tx.QueryRow("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?", table, name)
+	} else {
+		row = tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?", name)
+	}
+	if err := row.Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	query := "CREATE INDEX "
+	if unique {
+		query = "CREATE UNIQUE INDEX "
+	}
+	_, err := tx.Exec(query + name + " ON " + table + " (" + columns + ")")
+	return err
+}
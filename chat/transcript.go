@@ -0,0 +1,73 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Line of a transcript
+type transcriptLine struct {
+	created, author, body string
+}
+
+// Plain text transcript of a session, one line per message, oldest first.
+// Staff transcripts also have the agents' internal notes, visitors' never do
+func Transcript(sessid string, staff bool) (string, error) {
+	session := NewSession(nil, nil)
+	if err := DB.GetByPk(session, sessid, "session"); err != nil {
+		return "", err
+	}
+	visitor := strings.Replace(*session.Alias, "_", " ", 1)
+	messages, err := LoadMessages(sessid)
+	if err != nil {
+		return "", err
+	}
+	lines := []transcriptLine{}
+	for _, msg := range messages {
+		author := visitor
+		if *msg.Author == "0" {
+			author = "Agent"
+			if *msg.Name != "" {
+				author = *msg.Name
+			}
+		}
+		lines = append(lines, transcriptLine{*msg.Created, author, *msg.Body})
+	}
+	if staff {
+		notes, err := LoadNotes(sessid)
+		if err != nil {
+			return "", err
+		}
+		for _, note := range notes {
+			lines = append(lines, transcriptLine{note.Created, "Note by " + note.Author, note.Body})
+		}
+	}
+	// created times sort as strings
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].created < lines[j].created })
+
+	var b strings.Builder
+	for _, line := range lines {
+		fmt.Fprintf(&b, "[%s] %s: %s\n", line.created, line.author, line.body)
+	}
+	return b.String(), nil
+}
+
+// Serves the visitor the transcript of their session, without notes
+func (s *Server) serveTranscript(w http.ResponseWriter, r *http.Request) {
+	session, err := s.authenticate(r)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+	text, err := Transcript(*session.SessionId, false)
+	if err != nil {
+		log.Println("Could not make transcript:", err)
+		http.Error(w, "Could not make the transcript", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(text))
+}
@@ -0,0 +1,76 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+// Bodies of system frames, telling the widget what happened in the conversation
+const (
+	SystemTransfer = "transfer" // the conversation was handed to Author, the name the new agent is shown with
+)
+
+// The room of the session's conversation, if it isn't closed
+func conversationRoom(sessid string) (*Conversation, mid.RoomID, error) {
+	conv, err := CurrentConversation(sessid)
+	if err != nil {
+		return nil, "", err
+	}
+	if conv == nil || conv.Room == "" {
+		return nil, "", fmt.Errorf("the visitor has no conversation open")
+	}
+	return conv, mid.RoomID(conv.Room), nil
+}
+
+// Invites the user to the room, unless they're in it already
+func (s *Server) inviteAgent(room mid.RoomID, user mid.UserID) error {
+	if joined, err := s.Mautrix_client.HasJoined(room, user); err == nil && joined {
+		return nil
+	}
+	return s.Mautrix_client.InviteUser(room, user)
+}
+
+// Hands the session's conversation to another agent, invited to its room. The
+// previous agent is removed from it if kick. Agents are told in the room, by
+// whoever asked, and the visitor by a system frame naming the new agent
+func (s *Server) Transfer(sessid string, to mid.UserID, by string, kick bool) error {
+	conv, room, err := conversationRoom(sessid)
+	if err != nil {
+		return err
+	}
+	if err := s.inviteAgent(room, to); err != nil {
+		return err
+	}
+	previous := mid.UserID(conv.Agent)
+	conv.Agent = to.String()
+	conv.State = StateAssigned
+	if err := conv.Save(); err != nil {
+		log.Println("Could not store conversation:", err)
+	}
+
+	note := fmt.Sprintf("%s transferred the conversation to %s", by, to)
+	if kick && previous != "" && previous != to {
+		if err := s.Mautrix_client.KickUser(room, previous, "conversation transferred to "+to.String()); err == nil {
+			note += fmt.Sprintf(", %s was removed", previous)
+		}
+	}
+	s.Mautrix_client.SendNotice(room, note)
+	name := s.profiles.Get(s.Mautrix_client, to).Name
+	s.publish(&SessionEvent{Session: sessid, Frame: &JSONMessage{Type: FrameSystem, Body: SystemTransfer, Author: name}})
+	return nil
+}
+
+// Pulls a supervisor into the session's conversation, which stays with its
+// agent. The visitor isn't told
+func (s *Server) Supervise(sessid string, supervisor mid.UserID, by string) error {
+	_, room, err := conversationRoom(sessid)
+	if err != nil {
+		return err
+	}
+	if err := s.inviteAgent(room, supervisor); err != nil {
+		return err
+	}
+	return s.Mautrix_client.SendNotice(room, fmt.Sprintf("%s invited %s to supervise the conversation", by, supervisor))
+}
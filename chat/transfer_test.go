@@ -0,0 +1,141 @@
+package chat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stores the session's conversation, in a room and assigned to the agent
+func newAssignedConversation(t *testing.T, sessid, agent string) *Conversation {
+	t.Helper()
+	conv := NewConversation(sessid)
+	conv.Room = "!room:example.org"
+	conv.State = StateAssigned
+	conv.Agent = agent
+	if err := conv.Create(); err != nil {
+		t.Fatal(err)
+	}
+	return conv
+}
+
+// System frames the transport was sent
+func systemFrames(transport *fakeTransport) []JSONMessage {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	found := []JSONMessage{}
+	for _, msg := range transport.sent {
+		if msg.Type == FrameSystem {
+			found = append(found, *msg)
+		}
+	}
+	return found
+}
+
+func TestTransfer(t *testing.T) {
+	for _, kick := range []bool{false, true} {
+		s := newTestServer(t)
+		hs := newFakeHomeserver(t, s)
+		transport := newFakeTransport()
+		c, done := listenTestClient(t, s, transport, "visitor")
+		newAssignedConversation(t, "visitor", alice.String())
+
+		if err := s.Transfer("visitor", bob, carol.String(), kick); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(hs.sent("/rooms/!room:example.org/invite {\"user_id\":\"" + bob.String())); n != 1 {
+			t.Errorf("invited bob %d times", n)
+		}
+		kicks := len(hs.sent("/rooms/!room:example.org/kick {\"reason\":\"conversation transferred to @bob:example.org\",\"user_id\":\"" + alice.String()))
+		if (kicks == 1) != kick || kicks > 1 {
+			t.Errorf("kicked alice %d times, kick %v", kicks, kick)
+		}
+		note := "@carol:example.org transferred the conversation to @bob:example.org"
+		if kick {
+			note += ", @alice:example.org was removed"
+		}
+		if n := len(hs.sent(note + "\"")); n != 1 {
+			t.Errorf("%d notices %q", n, note)
+		}
+		conv, err := CurrentConversation("visitor")
+		if err != nil || conv.Agent != bob.String() || conv.State != StateAssigned {
+			t.Errorf("conversation %+v after the transfer, %v", conv, err)
+		}
+		eventually(t, func() bool {
+			frames := systemFrames(transport)
+			return len(frames) == 1 && frames[0].Body == SystemTransfer
+		}, "the transfer frame")
+		c.Close()
+		waitFor(t, done, "the client to stop")
+	}
+}
+
+func TestSupervise(t *testing.T) {
+	s := newTestServer(t)
+	hs := newFakeHomeserver(t, s)
+	transport := newFakeTransport()
+	c, done := listenTestClient(t, s, transport, "visitor")
+	defer func() {
+		c.Close()
+		waitFor(t, done, "the client to stop")
+	}()
+	newAssignedConversation(t, "visitor", alice.String())
+
+	if err := s.Supervise("visitor", carol, alice.String()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(hs.sent("/invite {\"user_id\":\"" + carol.String())); n != 1 {
+		t.Errorf("invited the supervisor %d times", n)
+	}
+	if n := len(hs.sent("@alice:example.org invited @carol:example.org to supervise the conversation")); n != 1 {
+		t.Errorf("%d supervision notices", n)
+	}
+	if n := len(hs.sent("/kick")); n != 0 {
+		t.Errorf("kicked %d agents for a supervisor", n)
+	}
+	conv, err := CurrentConversation("visitor")
+	if err != nil || conv.Agent != alice.String() {
+		t.Errorf("conversation %+v after supervision, %v", conv, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if frames := systemFrames(transport); len(frames) != 0 {
+		t.Errorf("the visitor was told %+v", frames)
+	}
+}
+
+func TestAdminTransfer(t *testing.T) {
+	s := newTestServer(t)
+	hs := newFakeHomeserver(t, s)
+	newAssignedConversation(t, "visitor", alice.String())
+	admin := NewAdmin("secret", s)
+	post := func(body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/admin/transfer", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.authorized(admin.serveTransfer)(w, r)
+		return w.Code
+	}
+
+	for _, c := range []struct {
+		body string
+		code int
+	}{
+		{`{"session": "visitor", "agent": "bob"}`, http.StatusBadRequest},
+		{`{"agent": "@bob:example.org"}`, http.StatusBadRequest},
+		{`{"session": "nobody", "agent": "@bob:example.org"}`, http.StatusConflict},
+		{`{"session": "visitor", "agent": "@carol:example.org", "supervisor": true}`, http.StatusNoContent},
+		{`{"session": "visitor", "agent": "@bob:example.org", "kick": true}`, http.StatusNoContent},
+	} {
+		if code := post(c.body); code != c.code {
+			t.Errorf("answered %d to %s", code, c.body)
+		}
+	}
+	if n := len(hs.sent("The admin API invited @carol:example.org to supervise")); n != 1 {
+		t.Errorf("%d supervision notices", n)
+	}
+	if n := len(hs.sent("The admin API transferred the conversation to @bob:example.org, @alice:example.org was removed")); n != 1 {
+		t.Errorf("%d transfer notices", n)
+	}
+}
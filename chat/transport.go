@@ -0,0 +1,311 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How long a long-poll request waits for frames before returning empty, and
+// how long a long-polling client may go without polling before it's dropped
+const (
+	pollTimeout = 25 * time.Second
+	pollExpiry  = 2*pollTimeout + 10*time.Second
+)
+
+// Close codes sent to the visitor's browser, see RFC 6455
+const (
+	CloseNormal          = websocket.CloseNormalClosure
+	CloseGoingAway       = websocket.CloseGoingAway
+	ClosePolicyViolation = websocket.ClosePolicyViolation
+)
+
+// How frames reach a visitor's tab
+type Transport interface {
+	Send(msg *JSONMessage) error
+	Ping() error
+	Close(code int, reason string) error
+}
+
+// Transports which also carry the visitor's frames, the others post them to
+// the send endpoint. A zero timeout waits forever
+type Receiver interface {
+	Receive(msg *JSONMessage, timeout time.Duration) error
+}
+
+// Websocket connection, written to by the client's write goroutine only. Any
+// pong received extends the read deadline
+type wsTransport struct {
+	ws      *websocket.Conn
+	timeout int64 // current read timeout, in nanoseconds
+}
+
+func newWSTransport(ws *websocket.Conn, limits *ClientLimits) *wsTransport {
+	t := &wsTransport{ws: ws}
+	ws.SetReadLimit(limits.MaxFrameSize)
+	ws.EnableWriteCompression(limits.Compression)
+	ws.SetPongHandler(func(string) error {
+		if timeout := atomic.LoadInt64(&t.timeout); timeout > 0 {
+			ws.SetReadDeadline(time.Now().Add(time.Duration(timeout)))
+		}
+		return nil
+	})
+	return t
+}
+
+// Sends a frame, giving up if the peer doesn't take it within writeWait
+func (t *wsTransport) Send(msg *JSONMessage) error {
+	t.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.ws.WriteJSON(msg)
+}
+
+func (t *wsTransport) Ping() error {
+	return t.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+}
+
+func (t *wsTransport) Receive(msg *JSONMessage, timeout time.Duration) error {
+	atomic.StoreInt64(&t.timeout, int64(timeout))
+	if timeout > 0 {
+		t.ws.SetReadDeadline(time.Now().Add(timeout))
+	}
+	return t.ws.ReadJSON(msg)
+}
+
+// Sends a close frame with the code, then closes the connection
+func (t *wsTransport) Close(code int, reason string) error {
+	t.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	return t.ws.Close()
+}
+
+// Server-Sent Events stream, written to by the request's handler only
+type sseTransport struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (t *sseTransport) Send(msg *JSONMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(t.w, "data: %s\n\n", payload); err != nil {
+		return err
+	}
+	t.flusher.Flush()
+	return nil
+}
+
+// Proxies drop idle streams, a ping frame keeps this one busy
+func (t *sseTransport) Ping() error {
+	return t.Send(&JSONMessage{Type: FramePing})
+}
+
+func (t *sseTransport) Close(code int, reason string) error {
+	return nil
+}
+
+// Long-polling clients have nothing to write to, their frames wait in the
+// client's buffer until the next poll collects them
+type pollTransport struct{}
+
+func (t *pollTransport) Send(msg *JSONMessage) error {
+	return nil
+}
+
+func (t *pollTransport) Ping() error {
+	return nil
+}
+
+func (t *pollTransport) Close(code int, reason string) error {
+	return nil
+}
+
+// Streams the session's frames as Server-Sent Events, for browsers behind
+// proxies blocking websockets. The first event carries the client's ID, to
+// post frames to the send endpoint with
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	session, err := s.authenticate(r)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	s.recordPage(session, r)
+	transport := &sseTransport{w, flusher}
+	client := NewClient(transport, r.Context(), s, session)
+	if seq, ok := lastSeen(r); ok {
+		client.Ack(seq)
+	}
+	if err := transport.Send(&JSONMessage{Type: FrameHello, Body: strconv.Itoa(client.id)}); err != nil {
+		return
+	}
+	s.Add(client)
+	client.Listen()
+}
+
+type pollResponse struct {
+	Client int            `json:"client"`
+	Frames []*JSONMessage `json:"frames"`
+}
+
+// Long-polling variant of serveEvents. Without a client parameter it creates
+// a client, and returns its ID along with the history right away. Otherwise it
+// waits up to pollTimeout for frames of that client. The since parameter of
+// each poll acknowledges the previous one, and if that response was lost its
+// messages are returned again
+func (s *Server) servePoll(w http.ResponseWriter, r *http.Request) {
+	session, err := s.authenticate(r)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	var client *Client
+	if id, err := strconv.Atoi(r.URL.Query().Get("client")); err == nil {
+		if index := s.registry.Get(*session.SessionId); index != nil {
+			client = index.Client(id)
+		}
+		if client == nil {
+			http.Error(w, "Unknown client, poll without one to start over", http.StatusGone)
+			return
+		}
+	}
+
+	frames := []*JSONMessage{}
+	if client == nil {
+		s.recordPage(session, r)
+		client = NewClient(&pollTransport{}, context.Background(), s, session)
+		if seq, ok := lastSeen(r); ok {
+			client.Ack(seq)
+		}
+		client.touch()
+		s.Add(client)
+		go client.expire()
+		frames = client.drain(frames)
+	} else {
+		client.touch()
+		if seq, ok := lastSeen(r); ok {
+			client.Ack(seq)
+			frames = append(frames, client.unacked(0)...)
+		}
+		if len(frames) == 0 {
+			select {
+			case msg := <-client.ch:
+				client.sentFrame(msg)
+				frames = client.drain(append(frames, msg))
+			case <-time.After(pollTimeout):
+			case <-client.ctx.Done():
+			case <-r.Context().Done():
+			}
+		} else {
+			frames = client.drain(frames)
+		}
+		client.touch()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(&pollResponse{client.id, frames})
+}
+
+// Takes visitor frames for the SSE and long-polling transports, as a JSON
+// frame in the body. The client parameter, if given, keeps the frame from
+// being echoed back to the tab which sent it. Chat messages are answered with
+// their ack frame
+func (s *Server) serveSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Frames must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := s.authenticate(r)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+	var msg JSONMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&msg); err != nil {
+		http.Error(w, "Invalid frame", http.StatusBadRequest)
+		return
+	}
+
+	var client *Client
+	if id, err := strconv.Atoi(r.URL.Query().Get("client")); err == nil {
+		if index := s.registry.Get(*session.SessionId); index != nil {
+			client = index.Client(id)
+		}
+	}
+	if client == nil {
+		// not connected to this instance, everybody gets the frame. Whatever
+		// is written to this stand-in is dropped, as it's never polled
+		client = NewClient(&pollTransport{}, context.Background(), s, session)
+	}
+	ack := s.Receive(client, msg)
+	if ack == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ack)
+}
+
+// Sequence number of the last message the widget has, which it sends when it
+// reconnects so that only the messages it missed are replayed
+func lastSeen(r *http.Request) (int, bool) {
+	seq, err := strconv.Atoi(r.URL.Query().Get("since"))
+	if err != nil || seq < 0 {
+		return 0, false
+	}
+	return seq, true
+}
+
+func (c *Client) touch() {
+	atomic.StoreInt64(&c.lastPoll, time.Now().Unix())
+}
+
+// Closes a long-polling client once it stops polling
+func (c *Client) expire() {
+	ticker := time.NewTicker(pollTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			last := time.Unix(atomic.LoadInt64(&c.lastPoll), 0)
+			if time.Since(last) > pollExpiry {
+				log.Printf("client %d stopped polling, dropping it", c.id)
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// Appends every frame already waiting in the client's buffer
+func (c *Client) drain(frames []*JSONMessage) []*JSONMessage {
+	for {
+		select {
+		case msg := <-c.ch:
+			c.sentFrame(msg)
+			frames = append(frames, msg)
+		default:
+			return frames
+		}
+	}
+}
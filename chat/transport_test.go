@@ -0,0 +1,38 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeSendWithoutClient(t *testing.T) {
+	s := newTestServer(t)
+	hs := newFakeHomeserver(t, s)
+	newTestSession(t, "visitor", "!room:example.org")
+
+	for _, frame := range []string{
+		`{"type": "message", "id": "client-1", "body": "hello"}`,
+		`{"type": "edit", "id": "client-2", "ref": 1, "body": "hello again"}`,
+		`{"type": "close"}`,
+	} {
+		r := httptest.NewRequest("POST", "/entry/send", strings.NewReader(frame))
+		r.AddCookie(&http.Cookie{Name: "session_id", Value: "visitor"})
+		w := httptest.NewRecorder()
+		s.serveSend(w, r)
+		if w.Code != http.StatusOK && w.Code != http.StatusNoContent {
+			t.Fatalf("%s answered %d: %s", frame, w.Code, w.Body)
+		}
+		if strings.Contains(frame, "client-1") {
+			var ack JSONMessage
+			if err := json.NewDecoder(w.Body).Decode(&ack); err != nil || ack.Type != FrameAck || ack.Seq != 1 {
+				t.Errorf("acknowledged with %+v, %v", ack, err)
+			}
+		}
+	}
+	if len(hs.sent("hello")) == 0 {
+		t.Error("message not relayed to the room")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -61,10 +62,104 @@ func main() {
 		matrix_rypt = false
 	}
 
+	// Instances sharing the database must share a pub/sub backend too, and
+	// hold a lease, in seconds, to elect the one syncing with Matrix
+	pubsub_kind := os.Getenv("PUBSUB")
+	pubsub_url := os.Getenv("PUBSUB_URL")
+	instance_id := os.Getenv("INSTANCE_ID")
+	leader_lease, _ := strconv.Atoi(os.Getenv("LEADER_LEASE"))
+
+	// Heartbeat interval and timeout are in seconds
+	ws_ping, _ := strconv.Atoi(os.Getenv("WEBSOCKET_PING_INTERVAL"))
+	ws_timeout, _ := strconv.Atoi(os.Getenv("WEBSOCKET_PONG_TIMEOUT"))
+	ws_queue, _ := strconv.Atoi(os.Getenv("WEBSOCKET_QUEUE_SIZE"))
+	ws_frame, _ := strconv.ParseInt(os.Getenv("WEBSOCKET_MAX_FRAME"), 10, 64)
+	ws_drop := os.Getenv("WEBSOCKET_SLOW_CONSUMER") == "drop"
+	ws_deflate := os.Getenv("WEBSOCKET_COMPRESSION") != "false" && os.Getenv("WEBSOCKET_COMPRESSION") != "False"
+
+	// Visitors' text is sent to agents as plain text unless markdown is on
+	visitor_markdown := os.Getenv("VISITOR_MARKDOWN") == "true" || os.Getenv("VISITOR_MARKDOWN") == "True"
+	visitor_links := os.Getenv("VISITOR_LINKS") == "true" || os.Getenv("VISITOR_LINKS") == "True"
+
+	// Abuse limits, zero or unset disables each of them
+	rate_sessions, _ := strconv.Atoi(os.Getenv("RATE_SESSIONS_PER_IP"))
+	rate_messages, _ := strconv.Atoi(os.Getenv("RATE_MESSAGES_PER_SESSION"))
+	rate_rooms, _ := strconv.Atoi(os.Getenv("RATE_ROOMS"))
+	max_message, _ := strconv.Atoi(os.Getenv("MAX_MESSAGE_LENGTH"))
+
+	// Reverse proxies the visitor's IP address is taken from the headers of
+	trusted_proxies, err := chat.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES: ", err)
+	}
+	chat.TrustedProxies = trusted_proxies
+
+	// Pool of agents conversations are routed to, MATRIX_RECIPIENT if empty
+	routing_agents, err := chat.ParseAgents(os.Getenv("MATRIX_AGENTS"))
+	if err != nil {
+		log.Fatal("Invalid MATRIX_AGENTS: ", err)
+	}
+	routing_strategy := os.Getenv("ROUTING_STRATEGY")
+	agent_timeout, _ := strconv.Atoi(os.Getenv("AGENT_JOIN_TIMEOUT"))
+
+	// Room collecting visitors' messages while no agent is online, if any
+	offline_inbox := os.Getenv("OFFLINE_INBOX_ROOM")
+
+	// Business hours, always open if unset, and the holidays off them
+	hours, err := chat.ParseBusinessHours(os.Getenv("BUSINESS_HOURS"), os.Getenv("BUSINESS_TIMEZONE"),
+		os.Getenv("HOLIDAYS_ICS"), os.Getenv("AFTER_HOURS_MESSAGE"), os.Getenv("RESPONSE_TIME"))
+	if err != nil {
+		log.Fatal("Invalid BUSINESS_HOURS or HOLIDAYS_ICS: ", err)
+	}
+
+	// Names agents are shown with instead of their display names, and whether
+	// their avatars are shown too
+	agent_names, err := chat.ParseAgentNames(os.Getenv("AGENT_NAMES"))
+	if err != nil {
+		log.Fatal("Invalid AGENT_NAMES: ", err)
+	}
+	agent_avatars := os.Getenv("AGENT_AVATARS") != "false" && os.Getenv("AGENT_AVATARS") != "False"
+
+	// Greeting and FAQ rules the bot answers visitors with, if any
+	auto_replies := os.Getenv("AUTO_REPLIES")
+
+	// Prefix of agents' messages kept as internal notes, as notices are
+	internal_prefix := os.Getenv("INTERNAL_PREFIX")
+
+	// Token of the admin API, disabled if unset
+	admin_token := os.Getenv("ADMIN_TOKEN")
+
+	// Conversations each agent takes at once before visitors are queued
+	agent_capacity, _ := strconv.Atoi(os.Getenv("AGENT_CAPACITY"))
+
+	// Idle conversations are closed after that many minutes, zero or unset never
+	conversation_idle, _ := strconv.Atoi(os.Getenv("CONVERSATION_IDLE"))
+
+	// Retention windows are in days, zero or unset keeps data forever
+	retention_ip, _ := strconv.Atoi(os.Getenv("RETENTION_IP_DAYS"))
+	retention_msg, _ := strconv.Atoi(os.Getenv("RETENTION_MESSAGE_DAYS"))
+	retention_sess, _ := strconv.Atoi(os.Getenv("RETENTION_SESSION_DAYS"))
+	retention_intv, _ := strconv.Atoi(os.Getenv("RETENTION_INTERVAL"))
+	retention_redact := os.Getenv("RETENTION_REDACT") == "true" || os.Getenv("RETENTION_REDACT") == "True"
+	retention_dry := os.Getenv("RETENTION_DRY_RUN") == "true" || os.Getenv("RETENTION_DRY_RUN") == "True"
+
 	// Connect to database, no need to defer
 	db, err := chat.ConnectSQL(db_user, db_pass, db_name, db_ipad, db_port, db_type, *dbfile)
 
+	if instance_id != "" {
+		chat.InstanceID = instance_id
+	}
+	pubsub, err := chat.NewPubSub(pubsub_kind, pubsub_url)
+	if err != nil {
+		log.Fatal("Could not connect to the pub/sub backend: ", err)
+	}
+	var lease *chat.LeaderLease
+	if leader_lease > 0 {
+		lease = chat.NewLeaderLease("matrix-sync", chat.InstanceID, time.Duration(leader_lease)*time.Second)
+	}
+
 	// Make sure to exit cleanly
+	var server *chat.Server
 	c := make(chan os.Signal, 1)
 	signal.Notify(c,
 		os.Interrupt,
@@ -78,18 +173,56 @@ func main() {
 	go func() {
 		for range c { // when the process is killed
 			log.Print("Cleaning up")
+			if server != nil {
+				server.Shutdown()
+			}
+			if lease != nil {
+				lease.Release()
+			}
+			pubsub.Close()
 			db.GetDB().Close()
 			os.Exit(0)
 		}
 	}()
 
 	// If one wishes, they can move this to another file, but not database.go
-	App := chat.NewApp(matrix_time, matrix_rypt, db)
+	App := chat.NewApp(matrix_time, matrix_rypt, db, lease)
 	go App.Connect(matrix_recp, matrix_srvr, matrix_user, matrix_pass, matrix_rypt)
 
 	// websocket server
-	server := chat.NewServer("/entry", matrix_rypt, App)
+	heartbeat := chat.NewHeartbeat(time.Duration(ws_ping)*time.Second, time.Duration(ws_timeout)*time.Second)
+	limits := chat.NewClientLimits(ws_queue, ws_drop, ws_frame, ws_deflate)
+	formatting := chat.NewFormatting(visitor_markdown, visitor_links)
+	rates := chat.NewRateLimits(rate_sessions, rate_messages, rate_rooms, max_message)
+	routing := chat.NewRouting(routing_agents, routing_strategy, time.Duration(agent_timeout)*time.Second)
+	inbox := chat.NewOfflineInbox(offline_inbox)
+	queue := chat.NewQueue(agent_capacity)
+	profiles := chat.NewProfiles(agent_names, agent_avatars)
+	// the bot creates the tables as it connects, the canned responses are
+	// stored before that
+	if err := chat.NewStateStore(db.GetDB()).CreateTables(); err != nil {
+		log.Fatal("Could not create the tables: ", err)
+	}
+	replies, err := chat.LoadAutoReplies(auto_replies)
+	if err != nil {
+		log.Fatal("Could not load AUTO_REPLIES: ", err)
+	}
+	server = chat.NewServer("/entry", matrix_rypt, heartbeat, limits, formatting, rates, routing, inbox, hours, queue, profiles, replies, internal_prefix, pubsub, App)
 	go server.Listen()
+	go server.RunQueue()
+	chat.NewAdmin(admin_token, server).Register()
+	go server.CloseIdle(time.Duration(conversation_idle) * time.Minute)
+
+	// purges visitor data according to the retention policy
+	retention := chat.NewRetention(&chat.RetentionPolicy{
+		IPDays:      retention_ip,
+		MessageDays: retention_msg,
+		SessionDays: retention_sess,
+		Interval:    time.Duration(retention_intv) * time.Hour,
+		Redact:      retention_redact,
+		DryRun:      retention_dry,
+	}, server)
+	go retention.Run()
 
 	// static files
 	http.Handle("/", http.FileServer(http.Dir("webroot")))